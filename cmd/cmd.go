@@ -17,24 +17,71 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"flag"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"k8s.io/klog"
 
 	_ "github.com/golang/glog"
 )
 
-var Version string
+// klogFlags are the flags of klog, which the packages of the driver log
+// with. Those glog also registers on flag.CommandLine, such as -v, are
+// shadowed by glog's and copied over by syncKlogFlags.
+var klogFlags = flag.NewFlagSet("klog", flag.ExitOnError)
+
+// build metadata, set with -ldflags "-X" at build time
+var (
+	Version   string
+	GitCommit string
+	BuildDate string
+)
 
 // flags
 var (
+	configFile = ""
+
 	identity = "cosi.storage.k8s.io"
 	nodeID   = ""
 	protocol = ""
 	listen   = ""
-	//endpoint = "unix://csi/csi.sock"
+	mode     = modeAll
+	endpoint = "unix:///csi/csi.sock"
+
+	socketMode = "0660"
+
+	refreshFraction    = 0.8
+	credentialEncoding = "plain"
+	perNodeAccess      = false
+	probeInterval      = 10 * time.Second
+	shutdownTimeout    = 30 * time.Second
+	topologyLabels     = []string{}
+	topology           = map[string]string{}
+	maxVolumesPerNode  = int64(0)
+
+	kubeconfig   = ""
+	master       = ""
+	kubeAPIQPS   = float32(5)
+	kubeAPIBurst = 10
+	apiTimeout   = 10 * time.Second
+
+	metricsAddress = ""
+	healthAddress  = ""
+	stateDir       = ""
+
+	informerCache  = true
+	informerResync = 10 * time.Minute
+)
+
+// modes select which CSI services the driver registers
+const (
+	modeNode       = "node"
+	modeController = "controller"
+	modeAll        = "all"
 )
 
 var driverCmd = &cobra.Command{
@@ -43,7 +90,7 @@ var driverCmd = &cobra.Command{
 	Long: "This Container Storage Interface (CSI) driver provides the ability to reference Bucket and BucketAccess objects, extracting connection/credential information and writing it to the Pod's filesystem. This driver does not manage the lifecycle of the bucket or the backing of the objects themselves, it only acts as the middle-man.",
 	SilenceUsage: true,
 	RunE: func(c *cobra.Command, args []string) error {
-		return driver(args)
+		return driver(c.Context(), c.PersistentFlags(), args)
 	},
 }
 
@@ -51,32 +98,68 @@ func init() {
 	if Version == "" {
 		Version = "dev"
 	}
+	if GitCommit == "" {
+		GitCommit = "unknown"
+	}
+	if BuildDate == "" {
+		BuildDate = "unknown"
+	}
 
 	viper.AutomaticEnv()
 	// parse the go default flagset to get flags for glog and other packages in future
 	driverCmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
 	// defaulting this to true so that logs are printed to console
 	flag.Set("logtostderr", "true")
+	klog.InitFlags(klogFlags)
+	driverCmd.PersistentFlags().AddGoFlagSet(klogFlags)
 
+	driverCmd.PersistentFlags().StringVar(&configFile, "config", configFile, "YAML configuration file setting any flag by its name, and allowedNamespaces, outputFormat, gcInterval and tmpfsSize")
 	driverCmd.PersistentFlags().StringVarP(&identity, "identity", "i", identity, "identity of this COSI CSI driver")
-	//driverCmd.PersistentFlags().StringVarP(&endpoint, "endpoint", "e", endpoint, "endpoint at which COSI CSI driver is listening")
-	driverCmd.PersistentFlags().StringVarP(&nodeID, "node-id", "n", nodeID, "identity of the node in which COSI CSI driver is running")
+	driverCmd.PersistentFlags().StringVarP(&endpoint, "endpoint", "e", endpoint, "CSI endpoint to listen on, unix:///path/to/socket or tcp://host:port")
+	driverCmd.PersistentFlags().StringVar(&socketMode, "socket-mode", socketMode, "octal permissions of the unix socket of the endpoint")
+	driverCmd.PersistentFlags().StringVarP(&nodeID, "node-id", "n", nodeID, "identity of the node in which COSI CSI driver is running, defaults to $NODE_NAME or the hostname")
+	driverCmd.PersistentFlags().StringVarP(&mode, "mode", "m", mode, "CSI services to serve, one of node, controller, all")
 	driverCmd.PersistentFlags().StringVarP(&listen, "listen", "l", listen, "address of the listening socket for the node server")
-	driverCmd.PersistentFlags().StringVarP(&protocol, "protocol", "p", protocol, "must be one of tcp, tcp4, tcp6, unix, unixpacket")
+	driverCmd.PersistentFlags().StringVarP(&protocol, "protocol", "p", protocol, "must be one of tcp, unix")
+	driverCmd.PersistentFlags().MarkDeprecated("listen", "use --endpoint instead")
+	driverCmd.PersistentFlags().MarkDeprecated("protocol", "use --endpoint instead")
+	driverCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", kubeconfig, "path to a kubeconfig file, the in-cluster configuration is used if unset")
+	driverCmd.PersistentFlags().StringVar(&master, "master", master, "address of the API server, overrides the one in the kubeconfig")
+	driverCmd.PersistentFlags().Float32Var(&kubeAPIQPS, "kube-api-qps", kubeAPIQPS, "queries per second allowed towards the API server")
+	driverCmd.PersistentFlags().IntVar(&kubeAPIBurst, "kube-api-burst", kubeAPIBurst, "burst of queries allowed towards the API server")
+	driverCmd.PersistentFlags().DurationVar(&apiTimeout, "api-timeout", apiTimeout, "timeout of each API server call made while serving a request, 0 for none")
+	driverCmd.PersistentFlags().StringVar(&metricsAddress, "metrics-address", metricsAddress, "address at which Prometheus metrics are served on /metrics, e.g. :8080, disabled if empty")
+	driverCmd.PersistentFlags().StringVar(&healthAddress, "health-address", healthAddress, "address at which /healthz and /readyz are served, e.g. :9809, disabled if empty")
+	driverCmd.PersistentFlags().StringVar(&stateDir, "state-dir", stateDir, "directory that must be writable for /healthz to succeed, defaults to the directory of the unix socket")
+	driverCmd.PersistentFlags().BoolVar(&informerCache, "informer-cache", informerCache, "resolve COSI objects and pods of this node from informer caches, falling back to the API server on a miss")
+	driverCmd.PersistentFlags().DurationVar(&informerResync, "informer-resync", informerResync, "resync period of the informer caches")
+	driverCmd.PersistentFlags().StringVar(&credentialEncoding, "credential-encoding", credentialEncoding, "encoding of credential values in the connection file, one of plain, base64 (writes the legacy file with top-level protocol and connection keys and base64 encoded values, for consumers of earlier releases)")
+	driverCmd.PersistentFlags().BoolVar(&perNodeAccess, "per-node-access", perNodeAccess, "request bucket access for each node a volume is published to, requires attachRequired in the CSIDriver object")
+	driverCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "time in-flight requests are given to finish on shutdown")
+	driverCmd.PersistentFlags().DurationVar(&probeInterval, "probe-interval", probeInterval, "interval at which API server reachability and the COSI CRDs are checked for the readiness probe")
+	driverCmd.PersistentFlags().StringSliceVar(&topologyLabels, "topology-labels", topologyLabels, "node labels published as the accessible topology of the node, e.g. topology.kubernetes.io/zone,topology.kubernetes.io/region")
+	driverCmd.PersistentFlags().StringToStringVar(&topology, "topology", topology, "static segments added to the accessible topology of the node, e.g. topology.kubernetes.io/region=us-east-1")
+	driverCmd.PersistentFlags().Int64Var(&maxVolumesPerNode, "max-volumes-per-node", maxVolumesPerNode, "maximum number of volumes kubelet places on the node, 0 for unlimited")
+	driverCmd.PersistentFlags().Float64Var(&refreshFraction, "refresh-fraction", refreshFraction, "fraction of the remaining lifetime of expiring credentials after which they are refreshed, between 0 and 1")
 
 	driverCmd.PersistentFlags().MarkHidden("alsologtostderr")
 	driverCmd.PersistentFlags().MarkHidden("log_backtrace_at")
 	driverCmd.PersistentFlags().MarkHidden("log_dir")
 	driverCmd.PersistentFlags().MarkHidden("logtostderr")
-	driverCmd.PersistentFlags().MarkHidden("master")
 	driverCmd.PersistentFlags().MarkHidden("stderrthreshold")
 	driverCmd.PersistentFlags().MarkHidden("vmodule")
+	driverCmd.PersistentFlags().MarkHidden("add_dir_header")
+	driverCmd.PersistentFlags().MarkHidden("log_file")
+	driverCmd.PersistentFlags().MarkHidden("log_file_max_size")
+	driverCmd.PersistentFlags().MarkHidden("skip_headers")
+	driverCmd.PersistentFlags().MarkHidden("skip_log_headers")
 
 	// suppress the incorrect prefix in glog output
 	flag.CommandLine.Parse([]string{})
 	viper.BindPFlags(driverCmd.PersistentFlags())
 }
 
-func Execute() error {
-	return driverCmd.Execute()
+// Execute runs the driver until ctx is cancelled.
+func Execute(ctx context.Context) error {
+	return driverCmd.ExecuteContext(ctx)
 }
@@ -0,0 +1,177 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog"
+)
+
+// fileConfig holds the settings that have no flag and are only read from
+// the configuration file, next to the flags keyed by their names.
+type fileConfig struct {
+	// AllowedNamespaces restricts the namespaces of the staged
+	// bucketAccessRequests, all are allowed if empty. Reloaded on change.
+	AllowedNamespaces []string `mapstructure:"allowedNamespaces"`
+	// OutputFormat of the connection file, only json is supported.
+	OutputFormat string `mapstructure:"outputFormat"`
+	// GCInterval is how often the refreshes of volumes whose staging path is
+	// gone are cancelled.
+	GCInterval time.Duration `mapstructure:"gcInterval"`
+	// TmpfsSize is the size of a tmpfs mounted at every staging path, such as
+	// 1Mi. Staging paths are written as is if unset.
+	TmpfsSize string `mapstructure:"tmpfsSize"`
+}
+
+// settings are the file-only settings in effect, defaulted for when no
+// configuration file is given.
+var settings = fileConfig{
+	OutputFormat: "json",
+	GCInterval:   5 * time.Minute,
+}
+
+// reloadableFlags are applied again when the configuration file changes.
+var reloadableFlags = []string{"v", "vmodule"}
+
+// loadConfig reads the configuration file into the flags not set on the
+// command line and into settings.
+func loadConfig(flags *pflag.FlagSet) error {
+	viper.SetConfigFile(configFile)
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read --config %q: %v", configFile, err)
+	}
+
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Name == "config" || !viper.InConfig(f.Name) {
+			return
+		}
+		if serr := f.Value.Set(flagValue(viper.Get(f.Name))); serr != nil {
+			err = fmt.Errorf("invalid %q in --config %q: %v", f.Name, configFile, serr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return readSettings()
+}
+
+// readSettings unmarshals the file-only settings over their defaults.
+func readSettings() error {
+	s := settings
+	if err := viper.Unmarshal(&s); err != nil {
+		return fmt.Errorf("invalid settings in --config %q: %v", configFile, err)
+	}
+	if s.OutputFormat != "json" {
+		return fmt.Errorf("outputFormat in --config %q must be json, got %q", configFile, s.OutputFormat)
+	}
+	if s.GCInterval < 0 {
+		return fmt.Errorf("gcInterval in --config %q must not be negative, got %v", configFile, s.GCInterval)
+	}
+	if _, err := tmpfsBytes(s.TmpfsSize); err != nil {
+		return err
+	}
+	settings = s
+	return nil
+}
+
+// watchConfig reapplies the reloadable flags and settings, passing the
+// allowed namespaces to setNamespaces, whenever the configuration file
+// changes. Other changes need a restart.
+func watchConfig(flags *pflag.FlagSet, setNamespaces func([]string)) {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		klog.Infof("configuration file %q changed, reloading", e.Name)
+		for _, name := range reloadableFlags {
+			f := flags.Lookup(name)
+			if f == nil || f.Changed || !viper.InConfig(name) {
+				continue
+			}
+			if err := f.Value.Set(flagValue(viper.Get(name))); err != nil {
+				klog.Errorf("failed to reload %q: %v", name, err)
+			}
+		}
+		if err := syncKlogFlags(flags); err != nil {
+			klog.Errorf("failed to reload logging flags: %v", err)
+		}
+		if err := readSettings(); err != nil {
+			klog.Errorf("failed to reload settings, keeping the previous ones: %v", err)
+			return
+		}
+		if setNamespaces != nil {
+			setNamespaces(settings.AllowedNamespaces)
+		}
+	})
+	viper.WatchConfig()
+}
+
+// syncKlogFlags sets the klog flags shadowed by glog's flags of the same
+// name to the values of the latter, so that both log alike.
+func syncKlogFlags(flags *pflag.FlagSet) error {
+	var err error
+	klogFlags.VisitAll(func(f *flag.Flag) {
+		pf := flags.Lookup(f.Name)
+		if err != nil || pf == nil || pf.Value.String() == f.Value.String() {
+			return
+		}
+		if serr := f.Value.Set(pf.Value.String()); serr != nil {
+			err = fmt.Errorf("invalid %q: %v", f.Name, serr)
+		}
+	})
+	return err
+}
+
+// flagValue formats a value read from the configuration file the way it
+// would be passed on the command line.
+func flagValue(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, fmt.Sprint(e))
+		}
+		return strings.Join(values, ",")
+	case map[string]interface{}:
+		pairs := make([]string, 0, len(v))
+		for k, e := range v {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", k, e))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// tmpfsBytes parses a tmpfs size such as 1Mi, an empty size is 0.
+func tmpfsBytes(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(size)
+	if err != nil || q.Sign() < 0 {
+		return 0, fmt.Errorf("tmpfsSize in --config %q must be a size such as 1Mi, got %q", configFile, size)
+	}
+	return q.Value(), nil
+}
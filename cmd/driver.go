@@ -17,45 +17,308 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/controller"
+	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 
 	cs "github.com/container-object-storage-interface/api/clientset/typed/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
-	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/connection"
 	id "github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/identity"
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/metrics"
 	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/node"
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/server"
 )
 
-func driver(args []string) error {
+func driver(ctx context.Context, flags *pflag.FlagSet, args []string) error {
+	if configFile != "" {
+		if err := loadConfig(flags); err != nil {
+			return err
+		}
+	}
+	if err := syncKlogFlags(flags); err != nil {
+		return err
+	}
+	tmpfsSize, err := tmpfsBytes(settings.TmpfsSize)
+	if err != nil {
+		return err
+	}
+	if refreshFraction <= 0 || refreshFraction >= 1 {
+		return fmt.Errorf("--refresh-fraction must be between 0 and 1, got %v", refreshFraction)
+	}
+	if credentialEncoding != "plain" && credentialEncoding != "base64" {
+		return fmt.Errorf("--credential-encoding must be one of plain, base64, got %q", credentialEncoding)
+	}
+	if probeInterval <= 0 {
+		return fmt.Errorf("--probe-interval must be positive, got %v", probeInterval)
+	}
+	if informerResync < 0 {
+		return fmt.Errorf("--informer-resync must not be negative, got %v", informerResync)
+	}
+	if apiTimeout < 0 {
+		return fmt.Errorf("--api-timeout must not be negative, got %v", apiTimeout)
+	}
+	if shutdownTimeout < 0 {
+		return fmt.Errorf("--shutdown-timeout must not be negative, got %v", shutdownTimeout)
+	}
+	if maxVolumesPerNode < 0 {
+		return fmt.Errorf("--max-volumes-per-node must not be negative, got %d", maxVolumesPerNode)
+	}
+	if kubeAPIQPS <= 0 || kubeAPIBurst <= 0 {
+		return fmt.Errorf("--kube-api-qps and --kube-api-burst must be positive, got %v and %d", kubeAPIQPS, kubeAPIBurst)
+	}
+	if mode != modeNode && mode != modeController && mode != modeAll {
+		return fmt.Errorf("--mode must be one of %s, %s, %s, got %q", modeNode, modeController, modeAll, mode)
+	}
+
+	// the deprecated --protocol and --listen take precedence when set
+	if listen != "" {
+		if protocol == "" {
+			protocol = "unix"
+		}
+		endpoint = protocol + "://" + listen
+	}
+	if _, _, err := server.ParseEndpoint(endpoint); err != nil {
+		return fmt.Errorf("--endpoint: %v", err)
+	}
+	perm, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil || perm > 0777 {
+		return fmt.Errorf("--socket-mode must be octal permissions such as 0660, got %q", socketMode)
+	}
+
+	config, err := restConfig()
+	if err != nil {
+		return err
+	}
+	client, err := cs.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create COSI client: %v", err)
+	}
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	if err := resolveNodeID(ctx, kube); err != nil {
+		return err
+	}
+
+	readiness, err := id.NewReadiness(config, probeInterval)
+	if err != nil {
+		return err
+	}
+	go readiness.Run(ctx.Done())
+
+	// leave the unused service nil so that it is not registered at all
+	var nodeServer csi.NodeServer
+	var ns *node.NodeServer
+	if mode != modeController {
+		ns = node.NewNodeServer(identity, nodeID, *client, kube, node.Config{
+			RefreshFraction:   refreshFraction,
+			LegacyEncoding:    credentialEncoding == "base64",
+			TopologyLabels:    topologyLabels,
+			Topology:          topology,
+			MaxVolumesPerNode: maxVolumesPerNode,
+			APITimeout:        apiTimeout,
+			Cache:             informerCache,
+			CacheResync:       informerResync,
+			AllowedNamespaces: settings.AllowedNamespaces,
+			TmpfsSize:         tmpfsSize,
+			GCInterval:        settings.GCInterval,
+		})
+		ns.Start(ctx.Done())
+		nodeServer = ns
+		glog.V(5).Infof("node server enabled")
+	}
+	var controllerServer csi.ControllerServer
+	if mode != modeNode {
+		c, err := controller.NewControllerServer(identity, nodeID, client, perNodeAccess)
+		if err != nil {
+			return err
+		}
+		controllerServer = c
+		glog.V(5).Infof("controller server enabled")
+	}
 
-	if protocol == "unix" {
-		if err := os.RemoveAll(listen); err != nil {
-			klog.Fatalf("could not prepare socket: %v", err)
+	if configFile != "" {
+		var setNamespaces func([]string)
+		if ns != nil {
+			setNamespaces = ns.SetAllowedNamespaces
 		}
+		watchConfig(flags, setNamespaces)
 	}
 
-	idServer, err := id.NewIdentityServer(identity, Version, map[string]string{})
+	idServer, err := id.NewIdentityServer(identity, Version, manifest(), readiness, len(topology) > 0 || len(topologyLabels) > 0, controllerServer, nodeServer)
 	if err != nil {
 		return err
 	}
 	glog.V(5).Infof("identity server started")
 
-	config := &rest.Config{}
+	s, err := server.New(endpoint, os.FileMode(perm), idServer, controllerServer, nodeServer)
+	if err != nil {
+		return err
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	if err := serveHTTP(ctx, s, readiness); err != nil {
+		// remove the socket rather than leave it behind for the next start
+		s.Stop(0)
+		if ns != nil {
+			ns.Stop()
+		}
+		return err
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Wait()
+	}()
 
-	client := cs.NewForConfigOrDie(config)
-	kube := kubernetes.NewForConfigOrDie(config)
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	klog.Infof("shutting down, waiting up to %v for in-flight requests", shutdownTimeout)
+	s.Stop(shutdownTimeout)
+	if ns != nil {
+		ns.Stop()
+	}
+	klog.Info("shut down")
+	return nil
+}
 
-	nodeServer := node.NewNodeServer(identity, nodeID, *client, kube)
-	controllerServer, err := controller.NewControllerServer(identity, nodeID)
+// serveHTTP serves the metrics and health endpoints, sharing a server if
+// they are configured with the same address.
+func serveHTTP(ctx context.Context, s *server.Server, readiness *id.Readiness) error {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(listen, idServer, controllerServer, nodeServer)
-	s.Wait()
+	if metricsAddress != "" {
+		mux(metricsAddress).Handle("/metrics", metrics.Handler())
+	}
+	if healthAddress != "" {
+		liveness := map[string]server.Check{"grpc": s.Check}
+		dir := stateDir
+		if dir == "" {
+			dir = s.StateDir()
+		}
+		if dir != "" {
+			liveness["state-dir"] = server.CheckWritable(dir)
+		}
+		h := server.HealthHandler(liveness, map[string]server.Check{
+			"api-server": func(ctx context.Context) error {
+				if ok, msg := readiness.Ready(); !ok {
+					return errors.New(msg)
+				}
+				return nil
+			},
+		})
+		mux(healthAddress).Handle("/healthz", h)
+		mux(healthAddress).Handle("/readyz", h)
+	}
 
+	for address, m := range muxes {
+		if err := server.ServeHTTP(ctx, address, m); err != nil {
+			return err
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// restConfig returns the in-cluster client configuration, unless --kubeconfig
+// or --master point elsewhere.
+func restConfig() (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" && master == "" {
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load in-cluster configuration, set --kubeconfig or --master when running outside a cluster: %v", err)
+		}
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags(master, kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client configuration from --kubeconfig %q, --master %q: %v", kubeconfig, master, err)
+		}
+	}
+	config.QPS = kubeAPIQPS
+	config.Burst = kubeAPIBurst
+	return config, nil
+}
+
+// nodeIDEnv is set from spec.nodeName through the downward API.
+const nodeIDEnv = "NODE_NAME"
+
+// resolveNodeID defaults nodeID to $NODE_NAME, or the hostname, and, if the
+// node server is enabled, checks that the node object exists, since kubelet
+// registers the driver under this ID.
+func resolveNodeID(ctx context.Context, kube kubernetes.Interface) error {
+	if nodeID == "" {
+		nodeID = os.Getenv(nodeIDEnv)
+	}
+	if nodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("--node-id not set, $%s empty and hostname unavailable: %v", nodeIDEnv, err)
+		}
+		nodeID = hostname
+	}
+	if nodeID == "" {
+		return fmt.Errorf("--node-id not set, $%s and hostname empty", nodeIDEnv)
+	}
+	if mode == modeController {
+		return nil
+	}
+
+	if _, err := kube.CoreV1().Nodes().Get(ctx, nodeID, metav1.GetOptions{}); err != nil {
+		return fmt.Errorf("node %q not found, set --node-id or $%s to the name of this node: %v", nodeID, nodeIDEnv, err)
+	}
+	klog.Infof("serving node %q", nodeID)
+	return nil
+}
+
+// manifest describes the build and configuration of the driver for GetPluginInfo.
+func manifest() map[string]string {
+	modes := []string{modeNode, modeController}
+	switch mode {
+	case modeNode:
+		modes = []string{modeNode}
+	case modeController:
+		modes = []string{modeController}
+	}
+	protocols := []string{
+		string(connection.ProtocolNameS3),
+		string(connection.ProtocolNameAzure),
+		string(connection.ProtocolNameGCS),
+	}
+	return map[string]string{
+		"gitCommit":           GitCommit,
+		"buildDate":           BuildDate,
+		"goVersion":           runtime.Version(),
+		"modes":               strings.Join(modes, ","),
+		"protocols":           strings.Join(protocols, ","),
+		"outputFormats":       "json",
+		"connectionVersion":   connection.APIVersion,
+		"credentialEncodings": "plain,base64",
+	}
+}
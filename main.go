@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -26,16 +27,24 @@ import (
 )
 
 func main() {
+	ctx, cancel := context.WithCancel(context.Background())
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGSEGV)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		s := <-sigs
-		glog.Infof("Exiting on signal %s %#v", s.String(), s)
-		panic("Signal received. Exiting")
+		glog.Infof("Exiting on signal %s", s.String())
+		cancel()
+		// a second signal skips the graceful shutdown
+		s = <-sigs
+		glog.Infof("Exiting immediately on signal %s", s.String())
+		glog.Flush()
+		os.Exit(1)
 	}()
 
-	if err := cmd.Execute(); err != nil {
+	err := cmd.Execute(ctx)
+	glog.Flush()
+	if err != nil {
 		os.Exit(1)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,82 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package capability validates the volume capabilities requested of the driver.
+package capability
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// AccessModes are the access modes supported by the driver. Credentials are
+// written per node, so a volume is either written on a single node or read
+// on any number of them.
+var AccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+}
+
+// Validate returns an error describing the first capability the driver does
+// not support.
+func Validate(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return fmt.Errorf("volume capabilities missing")
+	}
+	for _, c := range caps {
+		if err := validate(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validate(c *csi.VolumeCapability) error {
+	if c == nil {
+		return fmt.Errorf("volume capability missing")
+	}
+	if c.GetBlock() != nil {
+		return fmt.Errorf("block access is not supported, credentials can only be provided through a mounted filesystem")
+	}
+	if c.GetMount() == nil {
+		return fmt.Errorf("access type missing, only mount access is supported")
+	}
+
+	mode := c.GetAccessMode().GetMode()
+	for _, m := range AccessModes {
+		if m == mode {
+			return nil
+		}
+	}
+	supported := make([]string, 0, len(AccessModes))
+	for _, m := range AccessModes {
+		supported = append(supported, m.String())
+	}
+	return fmt.Errorf("access mode %s is not supported, must be one of %s", mode, strings.Join(supported, ", "))
+}
+
+// ReadOnly reports whether the capability only allows reading the volume.
+func ReadOnly(c *csi.VolumeCapability) bool {
+	switch c.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capability
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func mount(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		caps []*csi.VolumeCapability
+		// err is contained in the error, none is expected if empty
+		err string
+	}{
+		{name: "nil", caps: nil, err: "volume capabilities missing"},
+		{name: "empty", caps: []*csi.VolumeCapability{}, err: "volume capabilities missing"},
+		{name: "nil capability", caps: []*csi.VolumeCapability{nil}, err: "volume capability missing"},
+		{
+			name: "block",
+			caps: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			err: "block access is not supported",
+		},
+		{
+			name: "access type missing",
+			caps: []*csi.VolumeCapability{{
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			err: "access type missing",
+		},
+		{name: "single node writer", caps: []*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}},
+		{name: "single node reader", caps: []*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)}},
+		{name: "multi node reader", caps: []*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)}},
+		{
+			name: "multi node single writer",
+			caps: []*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER)},
+			err:  "access mode MULTI_NODE_SINGLE_WRITER is not supported",
+		},
+		{
+			name: "multi node multi writer",
+			caps: []*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+			err:  "access mode MULTI_NODE_MULTI_WRITER is not supported",
+		},
+		{
+			name: "unknown mode",
+			caps: []*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_UNKNOWN)},
+			err:  "access mode UNKNOWN is not supported",
+		},
+		{
+			name: "one unsupported among supported",
+			caps: []*csi.VolumeCapability{
+				mount(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				mount(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			},
+			err: "MULTI_NODE_MULTI_WRITER",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(test.caps)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Validate() = %v, want error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	for mode, want := range map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:       false,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:  true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:   true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: false,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:  false,
+	} {
+		if got := ReadOnly(mount(mode)); got != want {
+			t.Errorf("ReadOnly(%v) = %v, want %v", mode, got, want)
+		}
+	}
+	if ReadOnly(nil) {
+		t.Error("ReadOnly(nil) = true, want false")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// maxFileSize bounds how much of a connection file is read.
+const maxFileSize = 1 << 20
+
+// LoadDir reads the connection file from the directory the volume is mounted at.
+func LoadDir(dir string) (*Connection, error) {
+	return Load(filepath.Join(dir, FileName))
+}
+
+// Load reads and validates the connection file at path.
+func Load(path string) (*Connection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Read decodes and validates a connection file from r.
+func Read(r io.Reader) (*Connection, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFileSize {
+		return nil, fmt.Errorf("connection file exceeds %d bytes", maxFileSize)
+	}
+
+	c := &Connection{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid connection file: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks that c is a connection file of this version whose protocol
+// section matches its protocol name.
+func (c *Connection) Validate() error {
+	if c.APIVersion != APIVersion {
+		return fmt.Errorf("unsupported apiVersion %q, expected %q", c.APIVersion, APIVersion)
+	}
+	if c.Kind != Kind {
+		return fmt.Errorf("unsupported kind %q, expected %q", c.Kind, Kind)
+	}
+
+	set := 0
+	for _, s := range []bool{c.Protocol.S3 != nil, c.Protocol.AzureBlob != nil, c.Protocol.GCS != nil} {
+		if s {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("protocol %q has more than one protocol section set", c.Protocol.Name)
+	}
+
+	for _, k := range c.Base64Credentials {
+		v, ok := c.Credentials[k]
+		if !ok {
+			return fmt.Errorf("base64 credential %q missing", k)
+		}
+		if _, err := base64.StdEncoding.DecodeString(v); err != nil {
+			return fmt.Errorf("credential %q is not valid base64: %v", k, err)
+		}
+	}
+
+	var ok bool
+	switch c.Protocol.Name {
+	case ProtocolNameS3:
+		ok = c.Protocol.S3 != nil
+	case ProtocolNameAzure:
+		ok = c.Protocol.AzureBlob != nil
+	case ProtocolNameGCS:
+		ok = c.Protocol.GCS != nil
+	default:
+		return fmt.Errorf("unrecognized protocol %q", c.Protocol.Name)
+	}
+	if !ok {
+		return fmt.Errorf("protocol %q section missing", c.Protocol.Name)
+	}
+	return nil
+}
+
+// Credential returns the decoded value of the credential key.
+func (c *Connection) Credential(key string) ([]byte, error) {
+	v, ok := c.Credentials[key]
+	if !ok {
+		return nil, fmt.Errorf("credential %q not found", key)
+	}
+	for _, k := range c.Base64Credentials {
+		if k == key {
+			return base64.StdEncoding.DecodeString(v)
+		}
+	}
+	return []byte(v), nil
+}
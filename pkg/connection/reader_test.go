@@ -0,0 +1,238 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func validConnection() *Connection {
+	return &Connection{
+		APIVersion: APIVersion,
+		Kind:       Kind,
+		Protocol: Protocol{
+			Name:    ProtocolNameS3,
+			Version: "2006-03-01",
+			S3: &S3{
+				Endpoint:   "https://s3.example.com",
+				BucketName: "bucket",
+				Region:     "us-east-1",
+			},
+		},
+		Bucket: Bucket{
+			Name:                   "bucket",
+			BucketRequestName:      "br",
+			BucketRequestNamespace: "default",
+			BucketClassName:        "class",
+		},
+		Credentials: map[string]string{
+			"accessKeyID": "key",
+			"certificate": base64.StdEncoding.EncodeToString([]byte{0xff, 0x00}),
+		},
+		Base64Credentials: []string{"certificate"},
+	}
+}
+
+func TestReadRoundTrip(t *testing.T) {
+	want := validConnection()
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Read() = %+v, want %+v", got, want)
+	}
+
+	plain, err := got.Credential("accessKeyID")
+	if err != nil || string(plain) != "key" {
+		t.Errorf("Credential(accessKeyID) = %q, %v, want %q", plain, err, "key")
+	}
+	binary, err := got.Credential("certificate")
+	if err != nil || !bytes.Equal(binary, []byte{0xff, 0x00}) {
+		t.Errorf("Credential(certificate) = %v, %v, want %v", binary, err, []byte{0xff, 0x00})
+	}
+	if _, err := got.Credential("missing"); err == nil {
+		t.Error("Credential(missing) succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Connection)
+		err    string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Connection) {},
+		},
+		{
+			name:   "apiVersion",
+			modify: func(c *Connection) { c.APIVersion = "v0" },
+			err:    "unsupported apiVersion",
+		},
+		{
+			name:   "kind",
+			modify: func(c *Connection) { c.Kind = "Secret" },
+			err:    "unsupported kind",
+		},
+		{
+			name:   "unknown protocol",
+			modify: func(c *Connection) { c.Protocol.Name = "ftp" },
+			err:    `unrecognized protocol "ftp"`,
+		},
+		{
+			name:   "section of other protocol",
+			modify: func(c *Connection) { c.Protocol.Name = ProtocolNameGCS },
+			err:    `protocol "gcs" section missing`,
+		},
+		{
+			name:   "section missing",
+			modify: func(c *Connection) { c.Protocol.S3 = nil },
+			err:    `protocol "s3" section missing`,
+		},
+		{
+			name:   "two sections",
+			modify: func(c *Connection) { c.Protocol.AzureBlob = &AzureBlob{} },
+			err:    "more than one protocol section",
+		},
+		{
+			name:   "base64 credential missing",
+			modify: func(c *Connection) { c.Base64Credentials = append(c.Base64Credentials, "secretKey") },
+			err:    `base64 credential "secretKey" missing`,
+		},
+		{
+			name:   "base64 credential invalid",
+			modify: func(c *Connection) { c.Credentials["certificate"] = "not base64!" },
+			err:    `credential "certificate" is not valid base64`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := validConnection()
+			test.modify(c)
+			data, err := json.Marshal(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Read(bytes.NewReader(data))
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("Read() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Read() = %v, want error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReadSizeLimit(t *testing.T) {
+	c := validConnection()
+	c.Credentials["padding"] = strings.Repeat("x", maxFileSize)
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Read() = %v, want size error", err)
+	}
+
+	if _, err := Read(strings.NewReader("{")); err == nil || !strings.Contains(err.Error(), "invalid connection file") {
+		t.Errorf("Read() = %v, want decoding error", err)
+	}
+}
+
+// TestSchema checks that Schema describes the properties of the Go types,
+// requiring exactly the fields that are not omitted when empty.
+func TestSchema(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(Schema), &schema); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+	checkSchema(t, "", schema, reflect.TypeOf(Connection{}))
+
+	props := schema["properties"].(map[string]interface{})
+	if got := props["apiVersion"].(map[string]interface{})["const"]; got != APIVersion {
+		t.Errorf("apiVersion const = %v, want %q", got, APIVersion)
+	}
+	if got := props["kind"].(map[string]interface{})["const"]; got != Kind {
+		t.Errorf("kind const = %v, want %q", got, Kind)
+	}
+	name := props["protocol"].(map[string]interface{})["properties"].(map[string]interface{})["name"].(map[string]interface{})
+	var names []string
+	for _, n := range name["enum"].([]interface{}) {
+		names = append(names, n.(string))
+	}
+	sort.Strings(names)
+	want := []string{string(ProtocolNameAzure), string(ProtocolNameGCS), string(ProtocolNameS3)}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("protocol name enum = %v, want %v", names, want)
+	}
+}
+
+func checkSchema(t *testing.T, path string, schema map[string]interface{}, typ reflect.Type) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	required := map[string]bool{}
+	if r, ok := schema["required"].([]interface{}); ok {
+		for _, name := range r {
+			required[name.(string)] = true
+		}
+	}
+
+	fields := map[string]bool{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name, omitEmpty := tag[0], len(tag) > 1 && tag[1] == "omitempty"
+		fields[name] = true
+
+		prop, ok := props[name].(map[string]interface{})
+		if !ok {
+			t.Errorf("schema lacks property %s%s", path, name)
+			continue
+		}
+		if required[name] == omitEmpty {
+			t.Errorf("schema property %s%s required = %v, but omitempty = %v", path, name, required[name], omitEmpty)
+		}
+		checkSchema(t, path+name+".", prop, f.Type)
+	}
+	for name := range props {
+		if !fields[name] {
+			t.Errorf("schema property %s%s has no field in %s", path, name, typ.Name())
+		}
+	}
+}
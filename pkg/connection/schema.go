@@ -0,0 +1,88 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+// Schema is the JSON schema of the connection file, for consumers not written in Go.
+const Schema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://cosi.storage.k8s.io/schemas/connection/v1alpha1.json",
+  "title": "BucketConnection",
+  "type": "object",
+  "required": ["apiVersion", "kind", "protocol", "bucket", "credentials"],
+  "properties": {
+    "apiVersion": {"const": "connection.cosi.storage.k8s.io/v1alpha1"},
+    "kind": {"const": "BucketConnection"},
+    "protocol": {
+      "type": "object",
+      "required": ["name"],
+      "properties": {
+        "name": {"enum": ["s3", "azure", "gcs"]},
+        "version": {"type": "string"},
+        "s3": {
+          "type": "object",
+          "properties": {
+            "endpoint": {"type": "string"},
+            "bucketName": {"type": "string"},
+            "region": {"type": "string"},
+            "signatureVersion": {"enum": ["s3v2", "s3v4"]}
+          }
+        },
+        "azureBlob": {
+          "type": "object",
+          "properties": {
+            "storageAccount": {"type": "string"},
+            "containerName": {"type": "string"}
+          }
+        },
+        "gcs": {
+          "type": "object",
+          "properties": {
+            "bucketName": {"type": "string"},
+            "projectID": {"type": "string"},
+            "serviceAccount": {"type": "string"},
+            "privateKeyName": {"type": "string"}
+          }
+        }
+      },
+      "oneOf": [
+        {"properties": {"name": {"const": "s3"}}, "required": ["s3"]},
+        {"properties": {"name": {"const": "azure"}}, "required": ["azureBlob"]},
+        {"properties": {"name": {"const": "gcs"}}, "required": ["gcs"]}
+      ]
+    },
+    "bucket": {
+      "type": "object",
+      "required": ["name", "bucketRequestName", "bucketRequestNamespace"],
+      "properties": {
+        "name": {"type": "string"},
+        "bucketRequestName": {"type": "string"},
+        "bucketRequestNamespace": {"type": "string"},
+        "bucketClassName": {"type": "string"}
+      }
+    },
+    "credentials": {
+      "type": "object",
+      "additionalProperties": {"type": "string"}
+    },
+    "base64Credentials": {
+      "type": "array",
+      "items": {"type": "string"},
+      "uniqueItems": true
+    }
+  }
+}
+`
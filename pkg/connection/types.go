@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package connection defines the connection file the driver writes into a
+// pod's volume, and lets applications load it.
+package connection
+
+const (
+	// APIVersion is the version of the connection file schema defined by this package.
+	APIVersion = "connection.cosi.storage.k8s.io/v1alpha1"
+	// Kind identifies a connection file.
+	Kind = "BucketConnection"
+	// FileName is the name of the connection file within the volume.
+	FileName = "protocolConn.json"
+)
+
+// ProtocolName is the protocol used to reach the bucket.
+type ProtocolName string
+
+const (
+	ProtocolNameS3    ProtocolName = "s3"
+	ProtocolNameAzure ProtocolName = "azure"
+	ProtocolNameGCS   ProtocolName = "gcs"
+)
+
+// Connection is the content of the connection file.
+type Connection struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Protocol   Protocol `json:"protocol"`
+	Bucket     Bucket   `json:"bucket"`
+	// Credentials holds the minted Secret data. Values are plain strings
+	// unless their key is listed in Base64Credentials.
+	Credentials map[string]string `json:"credentials"`
+	// Base64Credentials lists the Credentials keys whose values are base64
+	// encoded, because they are not valid UTF-8.
+	// +optional
+	Base64Credentials []string `json:"base64Credentials,omitempty"`
+}
+
+// Bucket identifies the COSI objects the connection was resolved from.
+type Bucket struct {
+	Name                   string `json:"name"`
+	BucketRequestName      string `json:"bucketRequestName"`
+	BucketRequestNamespace string `json:"bucketRequestNamespace"`
+	// +optional
+	BucketClassName string `json:"bucketClassName,omitempty"`
+}
+
+// Protocol holds the section matching Name; the others are unset.
+type Protocol struct {
+	Name ProtocolName `json:"name"`
+	// Version is the version of the protocol, when the backend reports one.
+	// +optional
+	Version string `json:"version,omitempty"`
+	// +optional
+	S3 *S3 `json:"s3,omitempty"`
+	// +optional
+	AzureBlob *AzureBlob `json:"azureBlob,omitempty"`
+	// +optional
+	GCS *GCS `json:"gcs,omitempty"`
+}
+
+type S3 struct {
+	Endpoint   string `json:"endpoint,omitempty"`
+	BucketName string `json:"bucketName,omitempty"`
+	Region     string `json:"region,omitempty"`
+	// +optional
+	SignatureVersion string `json:"signatureVersion,omitempty"`
+}
+
+type AzureBlob struct {
+	StorageAccount string `json:"storageAccount,omitempty"`
+	ContainerName  string `json:"containerName,omitempty"`
+}
+
+type GCS struct {
+	BucketName string `json:"bucketName,omitempty"`
+	ProjectID  string `json:"projectID,omitempty"`
+	// +optional
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// +optional
+	PrivateKeyName string `json:"privateKeyName,omitempty"`
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	cs "github.com/container-object-storage-interface/api/clientset/typed/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/capability"
+)
+
+const (
+	// quotaKey is the BucketClass parameter holding the bytes available to
+	// all its buckets. quotaKey + "." + <topology segment value> overrides it
+	// for that segment, e.g. "quotaBytes.us-east-1a".
+	quotaKey = "quotaBytes"
+
+	// requestedBytesAnnotation records the capacity requested for a
+	// provisioned BucketRequest, which counts against its class' quota.
+	requestedBytesAnnotation = "cosi.storage.k8s.io/requested-bytes"
+	// topologyAnnotation records the comma separated topology segment values
+	// a BucketRequest was provisioned for, which select the segment quotas
+	// it counts against.
+	topologyAnnotation = "cosi.storage.k8s.io/topology"
+)
+
+// CapacityProvider reports the capacity available to new volumes of a
+// BucketClass within a topology segment, which may be nil.
+type CapacityProvider interface {
+	Capacity(ctx context.Context, bc *v1alpha1.BucketClass, topology *csi.Topology) (int64, error)
+}
+
+// NewClassCapacityProvider returns a CapacityProvider that subtracts the
+// capacity requested by the volumes provisioned by identity from the quota
+// set in BucketClass parameters. A segment quota only counts the volumes
+// provisioned for that segment, the class quota counts all of them. Classes
+// without a quota are unlimited.
+func NewClassCapacityProvider(identity string, c cs.ObjectstorageV1alpha1Interface) CapacityProvider {
+	return &classCapacityProvider{
+		identity:   identity,
+		cosiClient: c,
+	}
+}
+
+type classCapacityProvider struct {
+	identity   string
+	cosiClient cs.ObjectstorageV1alpha1Interface
+}
+
+func (p *classCapacityProvider) Capacity(ctx context.Context, bc *v1alpha1.BucketClass, topology *csi.Topology) (int64, error) {
+	quota, segment, ok, err := classQuota(bc, topology)
+	if err != nil || !ok {
+		return math.MaxInt64, err
+	}
+
+	brs, err := p.cosiClient.BucketRequests("").List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{provisionerLabel: p.identity}.String(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list bucketRequests: %v", err)
+	}
+	for _, br := range brs.Items {
+		if br.Spec.BucketClassName != bc.Name {
+			continue
+		}
+		if segment != "" && !hasSegment(br.Annotations[topologyAnnotation], segment) {
+			continue
+		}
+		if v, ok := br.Annotations[requestedBytesAnnotation]; ok {
+			requested, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("bucketRequest %s/%s has invalid annotation %q: %v", br.Namespace, br.Name, requestedBytesAnnotation, err)
+			}
+			quota -= requested
+		}
+	}
+	if quota < 0 {
+		return 0, nil
+	}
+	return quota, nil
+}
+
+// classQuota returns the quota of bc within topology, preferring a segment
+// specific parameter, and the segment value it is specific to, if any.
+func classQuota(bc *v1alpha1.BucketClass, topology *csi.Topology) (int64, string, bool, error) {
+	for _, segment := range append(segmentValues(topology), "") {
+		k := quotaKey
+		if segment != "" {
+			k += "." + segment
+		}
+		v, ok := bc.Parameters[k]
+		if !ok {
+			continue
+		}
+		quota, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, "", false, fmt.Errorf("bucketClass %q parameter %q is not a number of bytes: %v", bc.Name, k, err)
+		}
+		return quota, segment, true, nil
+	}
+	return 0, "", false, nil
+}
+
+// segmentValues returns the sorted values of the segments of topology.
+func segmentValues(topology *csi.Topology) []string {
+	var values []string
+	for _, v := range topology.GetSegments() {
+		values = append(values, v)
+	}
+	// map iteration order is random, keep the result deterministic
+	sort.Strings(values)
+	return values
+}
+
+// hasSegment reports whether the topologyAnnotation value annotation lists segment.
+func hasSegment(annotation, segment string) bool {
+	for _, v := range strings.Split(annotation, ",") {
+		if v == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCapacity reports the capacity available to volumes of the BucketClass
+// named in the StorageClass parameters.
+func (c *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if caps := req.GetVolumeCapabilities(); len(caps) > 0 {
+		if err := capability.Validate(caps); err != nil {
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+	bcName := req.GetParameters()[bucketClassKey]
+	if bcName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %q missing", bucketClassKey)
+	}
+	bc, err := c.cosiClient.BucketClasses().Get(ctx, bcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to get bucketClass %q: %v", bcName, err)
+	}
+
+	available, err := c.Capacity.Capacity(ctx, bc, req.GetAccessibleTopology())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
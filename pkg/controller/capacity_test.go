@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-object-storage-interface/api/clientset/fake"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func provisioned(name, bytes, topology string) *v1alpha1.BucketRequest {
+	br := &v1alpha1.BucketRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      map[string]string{provisionerLabel: "driver"},
+			Annotations: map[string]string{requestedBytesAnnotation: bytes},
+		},
+		Spec: v1alpha1.BucketRequestSpec{BucketClassName: "class"},
+	}
+	if topology != "" {
+		br.Annotations[topologyAnnotation] = topology
+	}
+	return br
+}
+
+func TestClassCapacity(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		provisioned("a", "10", "zone-a"),
+		provisioned("b", "20", "zone-b"),
+		provisioned("c", "40", ""),
+	)
+	p := NewClassCapacityProvider("driver", client.ObjectstorageV1alpha1())
+	bc := &v1alpha1.BucketClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "class"},
+		Parameters: map[string]string{
+			quotaKey:             "1000",
+			quotaKey + ".zone-a": "100",
+		},
+	}
+	zone := func(z string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"zone": z}}
+	}
+
+	tests := []struct {
+		name     string
+		topology *csi.Topology
+		want     int64
+	}{
+		{name: "class quota counts all volumes", topology: nil, want: 930},
+		{name: "segment quota counts the segment's volumes", topology: zone("zone-a"), want: 90},
+		{name: "segment without quota uses the class quota", topology: zone("zone-b"), want: 930},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := p.Capacity(context.Background(), bc, test.topology)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("Capacity() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
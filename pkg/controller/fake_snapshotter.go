@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewFakeSnapshotter returns a Snapshotter that keeps snapshots in memory and
+// reports them ready immediately, for tests.
+func NewFakeSnapshotter() Snapshotter {
+	return &fakeSnapshotter{
+		snapshots: make(map[string]*Snapshot),
+	}
+}
+
+type fakeSnapshotter struct {
+	lock      sync.Mutex
+	snapshots map[string]*Snapshot
+}
+
+func (f *fakeSnapshotter) Create(ctx context.Context, name, sourceVolumeID string, parameters map[string]string) (*Snapshot, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if s, ok := f.snapshots[name]; ok {
+		if s.SourceVolumeID != sourceVolumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %q already exists for another volume", name)
+		}
+		copied := *s
+		return &copied, nil
+	}
+	s := &Snapshot{
+		ID:             name,
+		SourceVolumeID: sourceVolumeID,
+		CreationTime:   time.Now(),
+		ReadyToUse:     true,
+	}
+	f.snapshots[name] = s
+	copied := *s
+	return &copied, nil
+}
+
+func (f *fakeSnapshotter) Delete(ctx context.Context, snapshotID string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.snapshots, snapshotID)
+	return nil
+}
+
+func (f *fakeSnapshotter) List(ctx context.Context, snapshotID, sourceVolumeID string) ([]*Snapshot, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	snapshots := make([]*Snapshot, 0, len(f.snapshots))
+	for _, s := range f.snapshots {
+		copied := *s
+		snapshots = append(snapshots, &copied)
+	}
+	return filterSnapshots(snapshots, snapshotID, sourceVolumeID), nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/capability"
+)
+
+const (
+	// volumeLabel names the volume a node scoped BucketAccessRequest grants access to.
+	volumeLabel = "cosi.storage.k8s.io/volume"
+	// nodeAnnotation is the ID of the node a BucketAccessRequest grants access to.
+	nodeAnnotation = "cosi.storage.k8s.io/node"
+	// bucketAccessClassAnnotation keeps the BucketAccessClass of a volume
+	// provisioned with per-node access, until it is published.
+	bucketAccessClassAnnotation = "cosi.storage.k8s.io/bucket-access-class"
+
+	// publish context keys, read back by the node server
+	bucketAccessNameKey = "bucket-access-name"
+)
+
+// nodeBARName derives the name of the BucketAccessRequest granting nodeID
+// access to volume name, hashing the node ID to keep the name short.
+func nodeBARName(name, nodeID string) string {
+	return fmt.Sprintf("%s-%x", name, sha256.Sum256([]byte(nodeID)))[:len(name)+11]
+}
+
+// ControllerPublishVolume requests access to the volume's bucket for the
+// node, and passes the granted BucketAccess on in the publish context.
+func (c *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if !c.perNodeAccess {
+		return nil, status.Error(codes.Unimplemented, "per-node access not enabled")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "node ID missing in request")
+	}
+	if err := capability.Validate([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ns, name, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	br, err := c.cosiClient.BucketRequests(ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.GetVolumeId())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get bucketRequest %s/%s: %v", ns, name, err)
+	}
+
+	barName := nodeBARName(name, req.GetNodeId())
+	bar := &v1alpha1.BucketAccessRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        barName,
+			Namespace:   ns,
+			Labels:      labels.Set{provisionerLabel: c.Identity, volumeLabel: name},
+			Annotations: map[string]string{nodeAnnotation: req.GetNodeId()},
+		},
+		Spec: v1alpha1.BucketAccessRequestSpec{
+			BucketRequestName:     name,
+			BucketAccessClassName: br.Annotations[bucketAccessClassAnnotation],
+		},
+	}
+	klog.Infof("creating bucketAccessRequest %s/%s for node %q", ns, barName, req.GetNodeId())
+	if _, err := c.cosiClient.BucketAccessRequests(ns).Create(ctx, bar, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return nil, status.Errorf(codes.Internal, "failed to create bucketAccessRequest %s/%s: %v", ns, barName, err)
+	}
+	if err := c.waitForGrant(ctx, ns, name, barName); err != nil {
+		return nil, err
+	}
+
+	bar, err = c.cosiClient.BucketAccessRequests(ns).Get(ctx, barName, metav1.GetOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get bucketAccessRequest %s/%s: %v", ns, barName, err)
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{
+			barNameKey:          barName,
+			barNamespaceKey:     ns,
+			bucketAccessNameKey: bar.Spec.BucketAccessName,
+		},
+	}, nil
+}
+
+// ControllerUnpublishVolume revokes the node's access to the volume's bucket.
+func (c *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if !c.perNodeAccess {
+		return nil, status.Error(codes.Unimplemented, "per-node access not enabled")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	ns, name, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		// not provisioned by this driver, so there is nothing to revoke
+		klog.Warning(err)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err := c.revokeNodeAccess(ctx, ns, name, req.GetNodeId()); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// revokeNodeAccess deletes the BucketAccessRequest granting nodeID access to
+// volume ns/name, or those of every node if nodeID is empty.
+func (c *ControllerServer) revokeNodeAccess(ctx context.Context, ns, name, nodeID string) error {
+	var names []string
+	if nodeID != "" {
+		names = append(names, nodeBARName(name, nodeID))
+	} else {
+		bars, err := c.cosiClient.BucketAccessRequests(ns).List(ctx, metav1.ListOptions{
+			LabelSelector: labels.Set{provisionerLabel: c.Identity, volumeLabel: name}.String(),
+		})
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to list bucketAccessRequests of %s/%s: %v", ns, name, err)
+		}
+		for _, bar := range bars.Items {
+			names = append(names, bar.Name)
+		}
+	}
+
+	for _, barName := range names {
+		klog.Infof("deleting bucketAccessRequest %s/%s", ns, barName)
+		if err := c.cosiClient.BucketAccessRequests(ns).Delete(ctx, barName, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return status.Errorf(codes.Internal, "failed to delete bucketAccessRequest %s/%s: %v", ns, barName, err)
+		}
+	}
+	return nil
+}
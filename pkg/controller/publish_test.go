@@ -0,0 +1,150 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/container-object-storage-interface/api/clientset/fake"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func publishRequest(nodeID string) *csi.ControllerPublishVolumeRequest {
+	return &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "default/vol",
+		NodeId:           nodeID,
+		VolumeCapability: mountCapability(),
+	}
+}
+
+// nodeBARs returns the names of the bucketAccessRequests of volume vol.
+func nodeBARs(t *testing.T, client *fake.Clientset) []string {
+	bars, err := client.ObjectstorageV1alpha1().BucketAccessRequests("default").List(context.Background(), metav1.ListOptions{
+		LabelSelector: labels.Set{volumeLabel: "vol"}.String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, bar := range bars.Items {
+		names = append(names, bar.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	ctx := context.Background()
+	br, _ := grantedVolume("vol")
+	br.Annotations[bucketAccessClassAnnotation] = "access"
+	c, client := newTestController(t, true, br)
+
+	resp, err := c.ControllerPublishVolume(ctx, publishRequest("node-a"))
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume() = %v", err)
+	}
+	barName := nodeBARName("vol", "node-a")
+	want := map[string]string{
+		barNameKey:          barName,
+		barNamespaceKey:     "default",
+		bucketAccessNameKey: "ba-" + barName,
+	}
+	if got := resp.GetPublishContext(); !reflect.DeepEqual(got, want) {
+		t.Errorf("publish context = %v, want %v", got, want)
+	}
+
+	bar, err := client.ObjectstorageV1alpha1().BucketAccessRequests("default").Get(ctx, barName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("bucketAccessRequest not created: %v", err)
+	}
+	if bar.Labels[volumeLabel] != "vol" || bar.Labels[provisionerLabel] != "driver" {
+		t.Errorf("bucketAccessRequest labels = %v", bar.Labels)
+	}
+	if bar.Annotations[nodeAnnotation] != "node-a" {
+		t.Errorf("bucketAccessRequest annotations = %v", bar.Annotations)
+	}
+	if bar.Spec.BucketRequestName != "vol" || bar.Spec.BucketAccessClassName != "access" {
+		t.Errorf("bucketAccessRequest spec = %+v", bar.Spec)
+	}
+
+	if _, err := c.ControllerPublishVolume(ctx, publishRequest("node-a")); err != nil {
+		t.Errorf("repeated ControllerPublishVolume() = %v", err)
+	}
+	req := publishRequest("node-a")
+	req.VolumeId = "default/unknown"
+	if _, err := c.ControllerPublishVolume(ctx, req); status.Code(err) != codes.NotFound {
+		t.Errorf("ControllerPublishVolume() of unknown volume = %v, want NotFound", err)
+	}
+	shared, _ := newTestController(t, false, br)
+	if _, err := shared.ControllerPublishVolume(ctx, publishRequest("node-a")); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ControllerPublishVolume() without per-node access = %v, want Unimplemented", err)
+	}
+}
+
+func TestControllerUnpublishVolume(t *testing.T) {
+	ctx := context.Background()
+	br, _ := grantedVolume("vol")
+	c, client := newTestController(t, true, br)
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		if _, err := c.ControllerPublishVolume(ctx, publishRequest(node)); err != nil {
+			t.Fatalf("ControllerPublishVolume(%s) = %v", node, err)
+		}
+	}
+
+	if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "default/vol", NodeId: "node-a"}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume() = %v", err)
+	}
+	want := []string{nodeBARName("vol", "node-b"), nodeBARName("vol", "node-c")}
+	sort.Strings(want)
+	if got := nodeBARs(t, client); !reflect.DeepEqual(got, want) {
+		t.Errorf("bucketAccessRequests after unpublishing node-a = %v, want %v", got, want)
+	}
+
+	if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "default/vol"}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume() from all nodes = %v", err)
+	}
+	if got := nodeBARs(t, client); len(got) != 0 {
+		t.Errorf("bucketAccessRequests after unpublishing all nodes = %v", got)
+	}
+}
+
+// TestDeleteVolumeRevokesNodeAccess checks that deleting a volume deletes the
+// bucketAccessRequests of all nodes it is published to.
+func TestDeleteVolumeRevokesNodeAccess(t *testing.T) {
+	ctx := context.Background()
+	br, _ := grantedVolume("vol")
+	c, client := newTestController(t, true, br)
+	for _, node := range []string{"node-a", "node-b"} {
+		if _, err := c.ControllerPublishVolume(ctx, publishRequest(node)); err != nil {
+			t.Fatalf("ControllerPublishVolume(%s) = %v", node, err)
+		}
+	}
+
+	if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "default/vol"}); err != nil {
+		t.Fatalf("DeleteVolume() = %v", err)
+	}
+	if got := nodeBARs(t, client); len(got) != 0 {
+		t.Errorf("bucketAccessRequests after DeleteVolume() = %v", got)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	cs "github.com/container-object-storage-interface/api/clientset/typed/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+const (
+	// snapshotModeKey is the VolumeSnapshotClass parameter choosing how
+	// snapshots are taken, one of snapshotModeClone or snapshotModeVersion.
+	snapshotModeKey = "snapshotMode"
+	// snapshotModeClone requests a new bucket cloned from the source bucket.
+	snapshotModeClone = "clone"
+	// snapshotModeVersion records a point-in-time marker on a versioned
+	// source bucket instead of copying it.
+	snapshotModeVersion = "version"
+
+	// cloneSourceAnnotation names the bucket a BucketRequest is cloned from,
+	// for COSI provisioners that support copying buckets.
+	cloneSourceAnnotation = "cosi.storage.k8s.io/clone-source"
+	// cloneSourceVolumeAnnotation is the ID of the volume a clone snapshots.
+	cloneSourceVolumeAnnotation = "cosi.storage.k8s.io/clone-source-volume"
+	// clonedAnnotation is set to "true" on a clone's BucketRequest by a
+	// provisioner once it copied the source bucket. Provisioners that ignore
+	// cloneSourceAnnotation create an empty bucket, so a clone is not ready
+	// to use until then.
+	clonedAnnotation = "cosi.storage.k8s.io/cloned"
+	// versionMarkerPrefix prefixes the source BucketRequest annotations that
+	// record version markers, keyed by snapshot name.
+	versionMarkerPrefix = "snapshot.cosi.storage.k8s.io/"
+)
+
+// Snapshot is a point-in-time copy of the bucket backing a volume.
+type Snapshot struct {
+	ID             string
+	SourceVolumeID string
+	CreationTime   time.Time
+	ReadyToUse     bool
+}
+
+// Snapshotter takes and removes snapshots of volumes.
+type Snapshotter interface {
+	// Create snapshots sourceVolumeID as name. It returns the existing
+	// snapshot if name already snapshots sourceVolumeID.
+	Create(ctx context.Context, name, sourceVolumeID string, parameters map[string]string) (*Snapshot, error)
+	// Delete removes the snapshot, succeeding if it does not exist.
+	Delete(ctx context.Context, snapshotID string) error
+	// List returns the snapshots ordered by ID, restricted to snapshotID
+	// and sourceVolumeID when set.
+	List(ctx context.Context, snapshotID, sourceVolumeID string) ([]*Snapshot, error)
+}
+
+// NewBucketSnapshotter returns a Snapshotter that clones buckets through new
+// BucketRequests, or records version markers on the source BucketRequest.
+func NewBucketSnapshotter(identity string, c cs.ObjectstorageV1alpha1Interface) Snapshotter {
+	return &bucketSnapshotter{
+		identity:   identity,
+		cosiClient: c,
+	}
+}
+
+type bucketSnapshotter struct {
+	identity   string
+	cosiClient cs.ObjectstorageV1alpha1Interface
+}
+
+// versionSnapshotID identifies the version marker name of the bucket behind volume ns/source.
+func versionSnapshotID(ns, source, name string) string {
+	return volumeID(ns, source) + "@" + name
+}
+
+func (s *bucketSnapshotter) Create(ctx context.Context, name, sourceVolumeID string, parameters map[string]string) (*Snapshot, error) {
+	ns, source, err := parseVolumeID(sourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+	src, err := s.cosiClient.BucketRequests(ns).Get(ctx, source, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "source volume %q not found", sourceVolumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get bucketRequest %s/%s: %v", ns, source, err)
+	}
+
+	switch mode := parameters[snapshotModeKey]; mode {
+	case "", snapshotModeClone:
+		return s.clone(ctx, name, sourceVolumeID, src)
+	case snapshotModeVersion:
+		return s.mark(ctx, name, sourceVolumeID, src)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %q must be one of %s, %s, got %q", snapshotModeKey, snapshotModeClone, snapshotModeVersion, mode)
+	}
+}
+
+func (s *bucketSnapshotter) clone(ctx context.Context, name, sourceVolumeID string, src *v1alpha1.BucketRequest) (*Snapshot, error) {
+	br := &v1alpha1.BucketRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: src.Namespace,
+			Labels:    labels.Set{provisionerLabel: s.identity},
+			Annotations: map[string]string{
+				cloneSourceAnnotation:       src.Spec.BucketInstanceName,
+				cloneSourceVolumeAnnotation: sourceVolumeID,
+			},
+		},
+		Spec: v1alpha1.BucketRequestSpec{
+			BucketPrefix:    src.Spec.BucketPrefix,
+			BucketClassName: src.Spec.BucketClassName,
+			Protocol:        src.Spec.Protocol,
+		},
+	}
+	klog.Infof("creating bucketRequest %s/%s cloned from %q", src.Namespace, name, src.Spec.BucketInstanceName)
+	created, err := s.cosiClient.BucketRequests(src.Namespace).Create(ctx, br, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		created, err = s.cosiClient.BucketRequests(src.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err == nil && created.Annotations[cloneSourceVolumeAnnotation] != sourceVolumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %q already exists for another volume", name)
+		}
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create bucketRequest %s/%s: %v", src.Namespace, name, err)
+	}
+	return cloneSnapshot(created), nil
+}
+
+func cloneSnapshot(br *v1alpha1.BucketRequest) *Snapshot {
+	return &Snapshot{
+		ID:             volumeID(br.Namespace, br.Name),
+		SourceVolumeID: br.Annotations[cloneSourceVolumeAnnotation],
+		CreationTime:   br.CreationTimestamp.Time,
+		ReadyToUse:     br.Status.BucketAvailable && br.Annotations[clonedAnnotation] == "true",
+	}
+}
+
+func (s *bucketSnapshotter) mark(ctx context.Context, name, sourceVolumeID string, src *v1alpha1.BucketRequest) (*Snapshot, error) {
+	key := versionMarkerPrefix + name
+	if _, ok := src.Annotations[key]; !ok {
+		if src.Annotations == nil {
+			src.Annotations = map[string]string{}
+		}
+		src.Annotations[key] = time.Now().UTC().Format(time.RFC3339)
+		klog.Infof("recording version marker %q on bucketRequest %s/%s", name, src.Namespace, src.Name)
+		var err error
+		src, err = s.cosiClient.BucketRequests(src.Namespace).Update(ctx, src, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update bucketRequest %s/%s: %v", src.Namespace, src.Name, err)
+		}
+	}
+	return versionSnapshot(src, name)
+}
+
+func versionSnapshot(src *v1alpha1.BucketRequest, name string) (*Snapshot, error) {
+	t, err := time.Parse(time.RFC3339, src.Annotations[versionMarkerPrefix+name])
+	if err != nil {
+		return nil, fmt.Errorf("bucketRequest %s/%s has invalid version marker %q: %v", src.Namespace, src.Name, name, err)
+	}
+	return &Snapshot{
+		ID:             versionSnapshotID(src.Namespace, src.Name, name),
+		SourceVolumeID: volumeID(src.Namespace, src.Name),
+		CreationTime:   t,
+		ReadyToUse:     true,
+	}, nil
+}
+
+func (s *bucketSnapshotter) Delete(ctx context.Context, snapshotID string) error {
+	if i := strings.LastIndex(snapshotID, "@"); i >= 0 {
+		ns, source, err := parseVolumeID(snapshotID[:i])
+		if err != nil {
+			return nil
+		}
+		src, err := s.cosiClient.BucketRequests(ns).Get(ctx, source, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to get bucketRequest %s/%s: %v", ns, source, err)
+		}
+		key := versionMarkerPrefix + snapshotID[i+1:]
+		if _, ok := src.Annotations[key]; !ok {
+			return nil
+		}
+		delete(src.Annotations, key)
+		klog.Infof("removing version marker %q from bucketRequest %s/%s", snapshotID[i+1:], ns, source)
+		if _, err := s.cosiClient.BucketRequests(ns).Update(ctx, src, metav1.UpdateOptions{}); err != nil {
+			return status.Errorf(codes.Internal, "failed to update bucketRequest %s/%s: %v", ns, source, err)
+		}
+		return nil
+	}
+
+	ns, name, err := parseVolumeID(snapshotID)
+	if err != nil {
+		return nil
+	}
+	br, err := s.cosiClient.BucketRequests(ns).Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get bucketRequest %s/%s: %v", ns, name, err)
+	}
+	if _, ok := br.Annotations[cloneSourceVolumeAnnotation]; !ok || br.Labels[provisionerLabel] != s.identity {
+		// a volume, not a snapshot, which must not be deleted here
+		klog.Warningf("bucketRequest %s/%s is not a snapshot clone, not deleting it", ns, name)
+		return nil
+	}
+	klog.Infof("deleting bucketRequest %s/%s", ns, name)
+	if err := s.cosiClient.BucketRequests(ns).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return status.Errorf(codes.Internal, "failed to delete bucketRequest %s/%s: %v", ns, name, err)
+	}
+	return nil
+}
+
+func (s *bucketSnapshotter) List(ctx context.Context, snapshotID, sourceVolumeID string) ([]*Snapshot, error) {
+	brs, err := s.cosiClient.BucketRequests("").List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{provisionerLabel: s.identity}.String(),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list bucketRequests: %v", err)
+	}
+
+	var snapshots []*Snapshot
+	for i := range brs.Items {
+		br := &brs.Items[i]
+		if _, ok := br.Annotations[cloneSourceVolumeAnnotation]; ok {
+			snapshots = append(snapshots, cloneSnapshot(br))
+		}
+		for k := range br.Annotations {
+			if !strings.HasPrefix(k, versionMarkerPrefix) {
+				continue
+			}
+			snap, err := versionSnapshot(br, strings.TrimPrefix(k, versionMarkerPrefix))
+			if err != nil {
+				klog.Warning(err)
+				continue
+			}
+			snapshots = append(snapshots, snap)
+		}
+	}
+	return filterSnapshots(snapshots, snapshotID, sourceVolumeID), nil
+}
+
+// filterSnapshots restricts snapshots to snapshotID and sourceVolumeID when
+// set, and orders them by ID.
+func filterSnapshots(snapshots []*Snapshot, snapshotID, sourceVolumeID string) []*Snapshot {
+	var filtered []*Snapshot
+	for _, s := range snapshots {
+		if snapshotID != "" && s.ID != snapshotID {
+			continue
+		}
+		if sourceVolumeID != "" && s.SourceVolumeID != sourceVolumeID {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].ID < filtered[j].ID })
+	return filtered
+}
+
+func toCSISnapshot(s *Snapshot) (*csi.Snapshot, error) {
+	created, err := ptypes.TimestampProto(s.CreationTime)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid creation time of snapshot %q: %v", s.ID, err)
+	}
+	return &csi.Snapshot{
+		SnapshotId:     s.ID,
+		SourceVolumeId: s.SourceVolumeID,
+		CreationTime:   created,
+		ReadyToUse:     s.ReadyToUse,
+	}, nil
+}
+
+func (c *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name missing in request")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "source volume ID missing in request")
+	}
+	snap, err := c.Snapshotter.Create(ctx, req.GetName(), req.GetSourceVolumeId(), req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	s, err := toCSISnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: s}, nil
+}
+
+func (c *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot ID missing in request")
+	}
+	if err := c.Snapshotter.Delete(ctx, req.GetSnapshotId()); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots pages through the snapshots, using the index of the first
+// entry as the starting token.
+func (c *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+	snapshots, err := c.Snapshotter.List(ctx, req.GetSnapshotId(), req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(snapshots) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+	end := len(snapshots)
+	if max := int(req.GetMaxEntries()); max > 0 && start+max < end {
+		end = start + max
+	}
+
+	resp := &csi.ListSnapshotsResponse{}
+	if end < len(snapshots) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	for _, snap := range snapshots[start:end] {
+		s, err := toCSISnapshot(snap)
+		if err != nil {
+			return nil, err
+		}
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: s})
+	}
+	return resp, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/container-object-storage-interface/api/clientset/fake"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	c := &ControllerServer{Snapshotter: NewFakeSnapshotter()}
+	for i := 0; i < 5; i++ {
+		_, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           fmt.Sprintf("snap-%d", i),
+			SourceVolumeId: fmt.Sprintf("default/vol-%d", i%2),
+		})
+		if err != nil {
+			t.Fatalf("CreateSnapshot() = %v", err)
+		}
+	}
+
+	resp, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap-0", SourceVolumeId: "default/vol-0"})
+	if err != nil || resp.GetSnapshot().GetSnapshotId() != "snap-0" {
+		t.Errorf("CreateSnapshot() of existing snapshot = %v, %v", resp, err)
+	}
+	_, err = c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap-0", SourceVolumeId: "default/vol-1"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateSnapshot() of existing snapshot for another volume = %v, want AlreadyExists", err)
+	}
+
+	list := func(req *csi.ListSnapshotsRequest) ([]string, string) {
+		t.Helper()
+		resp, err := c.ListSnapshots(ctx, req)
+		if err != nil {
+			t.Fatalf("ListSnapshots(%v) = %v", req, err)
+		}
+		var ids []string
+		for _, e := range resp.GetEntries() {
+			ids = append(ids, e.GetSnapshot().GetSnapshotId())
+		}
+		return ids, resp.GetNextToken()
+	}
+
+	var pages [][]string
+	token := ""
+	for {
+		ids, next := list(&csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: token})
+		pages = append(pages, ids)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	want := [][]string{{"snap-0", "snap-1"}, {"snap-2", "snap-3"}, {"snap-4"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("ListSnapshots() pages = %v, want %v", pages, want)
+	}
+
+	if ids, _ := list(&csi.ListSnapshotsRequest{SourceVolumeId: "default/vol-1"}); !reflect.DeepEqual(ids, []string{"snap-1", "snap-3"}) {
+		t.Errorf("ListSnapshots() of default/vol-1 = %v", ids)
+	}
+	if _, err := c.ListSnapshots(ctx, &csi.ListSnapshotsRequest{StartingToken: "6"}); status.Code(err) != codes.Aborted {
+		t.Errorf("ListSnapshots() with invalid token = %v, want Aborted", err)
+	}
+
+	for _, id := range []string{"snap-2", "snap-2"} {
+		if _, err := c.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: id}); err != nil {
+			t.Errorf("DeleteSnapshot(%s) = %v", id, err)
+		}
+	}
+	if ids, _ := list(&csi.ListSnapshotsRequest{}); !reflect.DeepEqual(ids, []string{"snap-0", "snap-1", "snap-3", "snap-4"}) {
+		t.Errorf("ListSnapshots() after delete = %v", ids)
+	}
+}
+
+func TestCloneSnapshot(t *testing.T) {
+	ctx := context.Background()
+	volume := provisioned("vol", "0", "")
+	volume.Spec.BucketInstanceName = "bucket"
+	client := fake.NewSimpleClientset(volume)
+	brs := client.ObjectstorageV1alpha1().BucketRequests("default")
+	s := NewBucketSnapshotter("driver", client.ObjectstorageV1alpha1())
+
+	snap, err := s.Create(ctx, "snap", "default/vol", nil)
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if snap.ID != "default/snap" || snap.SourceVolumeID != "default/vol" {
+		t.Errorf("Create() = %+v", snap)
+	}
+
+	clone, err := brs.Get(ctx, "snap", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := clone.Annotations[cloneSourceAnnotation]; got != "bucket" {
+		t.Errorf("clone source = %q, want bucket", got)
+	}
+	clone.Status.BucketAvailable = true
+	if snap := cloneSnapshot(clone); snap.ReadyToUse {
+		t.Error("clone ready to use before the provisioner confirmed the copy")
+	}
+	clone.Annotations[clonedAnnotation] = "true"
+	if snap := cloneSnapshot(clone); !snap.ReadyToUse {
+		t.Error("clone not ready to use after the provisioner confirmed the copy")
+	}
+
+	if err := s.Delete(ctx, "default/vol"); err != nil {
+		t.Errorf("Delete() of a volume ID = %v", err)
+	}
+	if _, err := brs.Get(ctx, "vol", metav1.GetOptions{}); err != nil {
+		t.Errorf("volume deleted as a snapshot: %v", err)
+	}
+	if err := s.Delete(ctx, "default/snap"); err != nil {
+		t.Errorf("Delete() = %v", err)
+	}
+	if _, err := brs.Get(ctx, "snap", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("clone not deleted: %v", err)
+	}
+}
+
+func TestCreateVolumeContentSource(t *testing.T) {
+	c := &ControllerServer{}
+	_, err := c.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "default/snap"},
+		}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume() from a snapshot = %v, want InvalidArgument", err)
+	}
+}
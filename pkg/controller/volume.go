@@ -0,0 +1,384 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/capability"
+)
+
+// StorageClass parameters
+const (
+	bucketClassKey       = "bucketClassName"
+	bucketAccessClassKey = "bucketAccessClassName"
+	bucketPrefixKey      = "bucketPrefix"
+	namespaceKey         = "namespace"
+	// set by csi-provisioner when run with --extra-create-metadata
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// volume context keys, read back by the node server
+const (
+	barNameKey      = "bar-name"
+	barNamespaceKey = "bar-namespace"
+	brNameKey       = "br-name"
+	brNamespaceKey  = "br-namespace"
+)
+
+// provisionerLabel marks the COSI objects created by a driver instance.
+const provisionerLabel = "cosi.storage.k8s.io/provisioner"
+
+const grantPollInterval = 2 * time.Second
+
+// volumeID encodes the namespace and name shared by the BucketRequest and
+// BucketAccessRequest backing a volume. The BucketRequest is what makes a
+// volume exist: with per-node access no BucketAccessRequest of that name is
+// created, so lookups by volume ID go to the BucketRequest.
+func volumeID(ns, name string) string {
+	return ns + "/" + name
+}
+
+func parseVolumeID(id string) (ns, name string, err error) {
+	parts := strings.SplitN(id, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", status.Errorf(codes.NotFound, "volume ID %q is not of the form <namespace>/<name>", id)
+	}
+	return parts[0], parts[1], nil
+}
+
+// CreateVolume requests a bucket and access to it from COSI, both named after
+// the volume, and returns once access has been granted. With per-node access
+// only the bucket is requested, access is requested per node on publish.
+func (c *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume name missing in request")
+	}
+	if err := capability.Validate(req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "volume content sources are not supported")
+	}
+	params := req.GetParameters()
+	bcName := params[bucketClassKey]
+	if bcName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %q missing", bucketClassKey)
+	}
+	ns := params[pvcNamespaceKey]
+	if ns == "" {
+		ns = params[namespaceKey]
+	}
+	if ns == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace unknown, set parameter %q or run csi-provisioner with --extra-create-metadata", namespaceKey)
+	}
+
+	bc, err := c.cosiClient.BucketClasses().Get(ctx, bcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to get bucketClass %q: %v", bcName, err)
+	}
+
+	owned := labels.Set{provisionerLabel: c.Identity}
+	br := &v1alpha1.BucketRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+			Labels:    owned,
+			Annotations: map[string]string{
+				requestedBytesAnnotation: strconv.FormatInt(req.GetCapacityRange().GetRequiredBytes(), 10),
+			},
+		},
+		Spec: v1alpha1.BucketRequestSpec{
+			BucketPrefix:    params[bucketPrefixKey],
+			BucketClassName: bcName,
+			Protocol:        v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolName(bc.Protocol)},
+		},
+	}
+	if c.perNodeAccess {
+		br.Annotations[bucketAccessClassAnnotation] = params[bucketAccessClassKey]
+	}
+	if topology := provisionedTopology(req.GetAccessibilityRequirements()); topology != nil {
+		br.Annotations[topologyAnnotation] = strings.Join(segmentValues(topology), ",")
+	}
+	klog.Infof("creating bucketRequest %s/%s", ns, name)
+	if _, err := c.cosiClient.BucketRequests(ns).Create(ctx, br, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return nil, status.Errorf(codes.Internal, "failed to create bucketRequest %s/%s: %v", ns, name, err)
+	}
+
+	barName := name
+	if c.perNodeAccess {
+		barName = ""
+	} else {
+		bar := &v1alpha1.BucketAccessRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: owned},
+			Spec: v1alpha1.BucketAccessRequestSpec{
+				BucketRequestName:     name,
+				BucketAccessClassName: params[bucketAccessClassKey],
+			},
+		}
+		klog.Infof("creating bucketAccessRequest %s/%s", ns, name)
+		if _, err := c.cosiClient.BucketAccessRequests(ns).Create(ctx, bar, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+			return nil, status.Errorf(codes.Internal, "failed to create bucketAccessRequest %s/%s: %v", ns, name, err)
+		}
+	}
+
+	if err := c.waitForGrant(ctx, ns, name, barName); err != nil {
+		return nil, err
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID(ns, name),
+			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+			VolumeContext: c.volumeContext(ns, name),
+		},
+	}, nil
+}
+
+// provisionedTopology returns the topology a volume is provisioned for: the
+// most preferred one, or the first requisite one, or nil.
+func provisionedTopology(req *csi.TopologyRequirement) *csi.Topology {
+	if preferred := req.GetPreferred(); len(preferred) > 0 {
+		return preferred[0]
+	}
+	if requisite := req.GetRequisite(); len(requisite) > 0 {
+		return requisite[0]
+	}
+	return nil
+}
+
+// volumeContext names the volume's bucketAccessRequest, unless access is
+// granted per node and passed in the publish context instead.
+func (c *ControllerServer) volumeContext(ns, name string) map[string]string {
+	if c.perNodeAccess {
+		return map[string]string{
+			brNameKey:      name,
+			brNamespaceKey: ns,
+		}
+	}
+	return map[string]string{
+		barNameKey:      name,
+		barNamespaceKey: ns,
+		brNameKey:       name,
+	}
+}
+
+// waitForGrant polls until the bucket is available and access to it granted
+// through the bucketAccessRequest barName, if set, or ctx is done.
+func (c *ControllerServer) waitForGrant(ctx context.Context, ns, brName, barName string) error {
+	var msg string
+	err := wait.PollImmediateUntil(grantPollInterval, func() (bool, error) {
+		br, err := c.cosiClient.BucketRequests(ns).Get(ctx, brName, metav1.GetOptions{})
+		if err != nil {
+			msg = err.Error()
+			return false, nil
+		}
+		if !br.Status.BucketAvailable {
+			msg = fmt.Sprintf("bucket not yet available: %s", br.Status.Message)
+			return false, nil
+		}
+		if barName == "" {
+			return true, nil
+		}
+		bar, err := c.cosiClient.BucketAccessRequests(ns).Get(ctx, barName, metav1.GetOptions{})
+		if err != nil {
+			msg = err.Error()
+			return false, nil
+		}
+		if !bar.Status.AccessGranted {
+			msg = fmt.Sprintf("access not yet granted: %s", bar.Status.Message)
+			return false, nil
+		}
+		return true, nil
+	}, ctx.Done())
+	if err != nil {
+		return status.Errorf(codes.DeadlineExceeded, "waiting for %s/%s: %s", ns, brName, msg)
+	}
+	return nil
+}
+
+// DeleteVolume removes the BucketAccessRequests and BucketRequest created for the volume.
+func (c *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	ns, name, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		// not provisioned by this driver, so there is nothing to delete
+		klog.Warning(err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	klog.Infof("deleting bucketAccessRequest %s/%s", ns, name)
+	if err := c.cosiClient.BucketAccessRequests(ns).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return nil, status.Errorf(codes.Internal, "failed to delete bucketAccessRequest %s/%s: %v", ns, name, err)
+	}
+	if err := c.revokeNodeAccess(ctx, ns, name, ""); err != nil {
+		return nil, err
+	}
+	klog.Infof("deleting bucketRequest %s/%s", ns, name)
+	if err := c.cosiClient.BucketRequests(ns).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return nil, status.Errorf(codes.Internal, "failed to delete bucketRequest %s/%s: %v", ns, name, err)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities confirms the requested capabilities if the
+// driver supports all of them. The volume exists if its BucketRequest does.
+func (c *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing in request")
+	}
+	ns, name, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.cosiClient.BucketRequests(ns).Get(ctx, name, metav1.GetOptions{}); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.GetVolumeId())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get bucketRequest %s/%s: %v", ns, name, err)
+	}
+
+	if err := capability.Validate(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// ListVolumes pages through the BucketRequests provisioned by this driver,
+// using the API server's continue token as the starting token. Pages may hold
+// fewer than max_entries volumes, as snapshot clones are skipped.
+func (c *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+	brs, err := c.cosiClient.BucketRequests("").List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{provisionerLabel: c.Identity}.String(),
+		Limit:         int64(req.GetMaxEntries()),
+		Continue:      req.GetStartingToken(),
+	})
+	if err != nil {
+		if errors.IsResourceExpired(err) || errors.IsBadRequest(err) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q: %v", req.GetStartingToken(), err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to list bucketRequests: %v", err)
+	}
+
+	resp := &csi.ListVolumesResponse{NextToken: brs.Continue}
+	for i := range brs.Items {
+		br := &brs.Items[i]
+		if _, ok := br.Annotations[cloneSourceVolumeAnnotation]; ok {
+			continue
+		}
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      volumeID(br.Namespace, br.Name),
+				VolumeContext: c.volumeContext(br.Namespace, br.Name),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: c.volumeCondition(ctx, br),
+			},
+		})
+	}
+	return resp, nil
+}
+
+// ControllerGetVolume reports the health of the bucket and access backing a
+// volume, looked up by its BucketRequest.
+func (c *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	ns, name, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	br, err := c.cosiClient.BucketRequests(ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.GetVolumeId())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get bucketRequest %s/%s: %v", ns, name, err)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      req.GetVolumeId(),
+			VolumeContext: c.volumeContext(ns, name),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: c.volumeCondition(ctx, br),
+		},
+	}, nil
+}
+
+// volumeCondition is abnormal unless the bucket is available and access to
+// it granted, through the volume's own BucketAccessRequest or, with per-node
+// access, those of every node it is published to.
+func (c *ControllerServer) volumeCondition(ctx context.Context, br *v1alpha1.BucketRequest) *csi.VolumeCondition {
+	if !br.Status.BucketAvailable {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("bucket not available: %s", br.Status.Message)}
+	}
+
+	var bars []v1alpha1.BucketAccessRequest
+	if c.perNodeAccess {
+		list, err := c.cosiClient.BucketAccessRequests(br.Namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: labels.Set{provisionerLabel: c.Identity, volumeLabel: br.Name}.String(),
+		})
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("failed to list bucketAccessRequests of %s/%s: %v", br.Namespace, br.Name, err)}
+		}
+		bars = list.Items
+	} else {
+		bar, err := c.cosiClient.BucketAccessRequests(br.Namespace).Get(ctx, br.Name, metav1.GetOptions{})
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("failed to get bucketAccessRequest %s/%s: %v", br.Namespace, br.Name, err)}
+		}
+		bars = append(bars, *bar)
+	}
+	for _, bar := range bars {
+		if !bar.Status.AccessGranted {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("access through bucketAccessRequest %s not granted: %s", bar.Name, bar.Status.Message)}
+		}
+	}
+	return &csi.VolumeCondition{Message: "bucket available and access granted"}
+}
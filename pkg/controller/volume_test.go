@@ -0,0 +1,367 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-object-storage-interface/api/clientset/fake"
+	cs "github.com/container-object-storage-interface/api/clientset/typed/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestController returns a ControllerServer of the driver "driver" backed
+// by a fake clientset, in which buckets are available and access granted as
+// soon as they are requested.
+func newTestController(t *testing.T, perNodeAccess bool, objects ...runtime.Object) (*ControllerServer, *fake.Clientset) {
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("create", "bucketrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		br := action.(k8stesting.CreateAction).GetObject().(*v1alpha1.BucketRequest)
+		br.Status.BucketAvailable = true
+		return false, nil, nil
+	})
+	client.PrependReactor("create", "bucketaccessrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		bar := action.(k8stesting.CreateAction).GetObject().(*v1alpha1.BucketAccessRequest)
+		bar.Spec.BucketAccessName = "ba-" + bar.Name
+		bar.Status.AccessGranted = true
+		return false, nil, nil
+	})
+	c, err := NewControllerServer("driver", "node", client.ObjectstorageV1alpha1(), perNodeAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func createVolumeRequest(params map[string]string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         params,
+	}
+}
+
+var bucketClass = &v1alpha1.BucketClass{
+	ObjectMeta: metav1.ObjectMeta{Name: "class"},
+	Protocol:   string(v1alpha1.ProtocolNameS3),
+}
+
+func TestCreateVolumeInvalidArgument(t *testing.T) {
+	c, _ := newTestController(t, false, bucketClass)
+	for name, params := range map[string]map[string]string{
+		"bucketClassName missing": {namespaceKey: "default"},
+		"namespace missing":       {bucketClassKey: "class"},
+		"bucketClass unknown":     {bucketClassKey: "other", namespaceKey: "default"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := c.CreateVolume(context.Background(), createVolumeRequest(params))
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("CreateVolume() = %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	ctx := context.Background()
+	c, client := newTestController(t, false, bucketClass)
+	req := createVolumeRequest(map[string]string{
+		bucketClassKey:       "class",
+		bucketAccessClassKey: "access",
+		pvcNamespaceKey:      "default",
+	})
+
+	first, err := c.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateVolume() = %v", err)
+	}
+	// retried, e.g. after the first response was lost
+	retried, err := c.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("retried CreateVolume() = %v", err)
+	}
+	if !reflect.DeepEqual(first.GetVolume(), retried.GetVolume()) {
+		t.Errorf("retried CreateVolume() = %v, want %v", retried.GetVolume(), first.GetVolume())
+	}
+	if id := first.GetVolume().GetVolumeId(); id != "default/vol" {
+		t.Errorf("volume ID = %q, want default/vol", id)
+	}
+	want := map[string]string{barNameKey: "vol", barNamespaceKey: "default", brNameKey: "vol"}
+	if got := first.GetVolume().GetVolumeContext(); !reflect.DeepEqual(got, want) {
+		t.Errorf("volume context = %v, want %v", got, want)
+	}
+
+	bar, err := client.ObjectstorageV1alpha1().BucketAccessRequests("default").Get(ctx, "vol", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("bucketAccessRequest not created: %v", err)
+	}
+	if bar.Spec.BucketRequestName != "vol" || bar.Spec.BucketAccessClassName != "access" {
+		t.Errorf("bucketAccessRequest spec = %+v", bar.Spec)
+	}
+}
+
+func TestCreateVolumePerNodeAccess(t *testing.T) {
+	ctx := context.Background()
+	c, client := newTestController(t, true, bucketClass)
+	resp, err := c.CreateVolume(ctx, createVolumeRequest(map[string]string{
+		bucketClassKey:       "class",
+		bucketAccessClassKey: "access",
+		namespaceKey:         "default",
+	}))
+	if err != nil {
+		t.Fatalf("CreateVolume() = %v", err)
+	}
+	want := map[string]string{brNameKey: "vol", brNamespaceKey: "default"}
+	if got := resp.GetVolume().GetVolumeContext(); !reflect.DeepEqual(got, want) {
+		t.Errorf("volume context = %v, want %v", got, want)
+	}
+
+	bars, err := client.ObjectstorageV1alpha1().BucketAccessRequests("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bars.Items) != 0 {
+		t.Errorf("CreateVolume() created bucketAccessRequests %v", bars.Items)
+	}
+	br, err := client.ObjectstorageV1alpha1().BucketRequests("default").Get(ctx, "vol", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("bucketRequest not created: %v", err)
+	}
+	if got := br.Annotations[bucketAccessClassAnnotation]; got != "access" {
+		t.Errorf("bucketAccessClass annotation = %q, want access", got)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	ctx := context.Background()
+	c, client := newTestController(t, false, bucketClass)
+	if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "not-provisioned-here"}); err != nil {
+		t.Errorf("DeleteVolume() of a foreign volume ID = %v", err)
+	}
+
+	_, err := c.CreateVolume(ctx, createVolumeRequest(map[string]string{bucketClassKey: "class", namespaceKey: "default"}))
+	if err != nil {
+		t.Fatalf("CreateVolume() = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "default/vol"}); err != nil {
+			t.Errorf("DeleteVolume() = %v", err)
+		}
+	}
+	brs, _ := client.ObjectstorageV1alpha1().BucketRequests("").List(ctx, metav1.ListOptions{})
+	bars, _ := client.ObjectstorageV1alpha1().BucketAccessRequests("").List(ctx, metav1.ListOptions{})
+	if len(brs.Items) != 0 || len(bars.Items) != 0 {
+		t.Errorf("DeleteVolume() left %d bucketRequests and %d bucketAccessRequests", len(brs.Items), len(bars.Items))
+	}
+}
+
+// pagedClient pages bucketRequest lists by Limit and Continue, which the
+// fake clientset ignores, using the index of the next item as token.
+type pagedClient struct {
+	cs.ObjectstorageV1alpha1Interface
+}
+
+func (c pagedClient) BucketRequests(ns string) cs.BucketRequestInterface {
+	return pagedBucketRequests{c.ObjectstorageV1alpha1Interface.BucketRequests(ns)}
+}
+
+type pagedBucketRequests struct {
+	cs.BucketRequestInterface
+}
+
+func (b pagedBucketRequests) List(ctx context.Context, opts metav1.ListOptions) (*v1alpha1.BucketRequestList, error) {
+	list, err := b.BucketRequestInterface.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return volumeID(list.Items[i].Namespace, list.Items[i].Name) < volumeID(list.Items[j].Namespace, list.Items[j].Name)
+	})
+	start := 0
+	if opts.Continue != "" {
+		start, err = strconv.Atoi(opts.Continue)
+		if err != nil || start > len(list.Items) {
+			return nil, errors.NewBadRequest("invalid continue token")
+		}
+	}
+	end := len(list.Items)
+	if opts.Limit > 0 && start+int(opts.Limit) < end {
+		end = start + int(opts.Limit)
+		list.Continue = strconv.Itoa(end)
+	}
+	list.Items = list.Items[start:end]
+	return list, nil
+}
+
+// grantedVolume returns the available bucketRequest and granted
+// bucketAccessRequest of a volume provisioned by the driver "driver".
+func grantedVolume(name string) (*v1alpha1.BucketRequest, *v1alpha1.BucketAccessRequest) {
+	br := provisioned(name, "0", "")
+	br.Status.BucketAvailable = true
+	bar := &v1alpha1.BucketAccessRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{provisionerLabel: "driver"}},
+		Status:     v1alpha1.BucketAccessRequestStatus{AccessGranted: true},
+	}
+	return br, bar
+}
+
+func TestListVolumes(t *testing.T) {
+	ctx := context.Background()
+	var objects []runtime.Object
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		br, bar := grantedVolume(name)
+		objects = append(objects, br, bar)
+	}
+	clone := provisioned("c-clone", "0", "")
+	clone.Annotations[cloneSourceVolumeAnnotation] = "default/c"
+	foreign := provisioned("foreign", "0", "")
+	foreign.Labels[provisionerLabel] = "other"
+	objects = append(objects, clone, foreign)
+
+	c, client := newTestController(t, false, objects...)
+	c.cosiClient = pagedClient{client.ObjectstorageV1alpha1()}
+
+	var pages [][]string
+	token := ""
+	for {
+		resp, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListVolumes() = %v", err)
+		}
+		var ids []string
+		for _, e := range resp.GetEntries() {
+			ids = append(ids, e.GetVolume().GetVolumeId())
+			if cond := e.GetStatus().GetVolumeCondition(); cond.GetAbnormal() {
+				t.Errorf("volume %s condition = %v, want normal", e.GetVolume().GetVolumeId(), cond)
+			}
+		}
+		pages = append(pages, ids)
+		if token = resp.GetNextToken(); token == "" {
+			break
+		}
+	}
+	// the clone takes a place in the second page
+	want := [][]string{{"default/a", "default/b"}, {"default/c"}, {"default/d", "default/e"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("ListVolumes() pages = %v, want %v", pages, want)
+	}
+
+	if _, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid"}); status.Code(err) != codes.Aborted {
+		t.Errorf("ListVolumes() with invalid token = %v, want Aborted", err)
+	}
+	if _, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListVolumes() with negative max_entries = %v, want InvalidArgument", err)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*v1alpha1.BucketRequest, *v1alpha1.BucketAccessRequest)
+		// abnormal is contained in the message of an abnormal condition,
+		// the condition is expected to be normal if empty
+		abnormal string
+	}{
+		{
+			name:   "available and granted",
+			modify: func(*v1alpha1.BucketRequest, *v1alpha1.BucketAccessRequest) {},
+		},
+		{
+			name: "bucket not available",
+			modify: func(br *v1alpha1.BucketRequest, _ *v1alpha1.BucketAccessRequest) {
+				br.Status.BucketAvailable = false
+				br.Status.Message = "quota exceeded"
+			},
+			abnormal: "bucket not available: quota exceeded",
+		},
+		{
+			name: "access not granted",
+			modify: func(_ *v1alpha1.BucketRequest, bar *v1alpha1.BucketAccessRequest) {
+				bar.Status.AccessGranted = false
+				bar.Status.Message = "denied"
+			},
+			abnormal: "not granted: denied",
+		},
+		{
+			name:     "bucketAccessRequest missing",
+			modify:   func(_ *v1alpha1.BucketRequest, bar *v1alpha1.BucketAccessRequest) { bar.Name = "other" },
+			abnormal: "failed to get bucketAccessRequest",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			br, bar := grantedVolume("vol")
+			test.modify(br, bar)
+			c, _ := newTestController(t, false, br, bar)
+
+			resp, err := c.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "default/vol"})
+			if err != nil {
+				t.Fatalf("ControllerGetVolume() = %v", err)
+			}
+			cond := resp.GetStatus().GetVolumeCondition()
+			if cond.GetAbnormal() != (test.abnormal != "") || !strings.Contains(cond.GetMessage(), test.abnormal) {
+				t.Errorf("condition = %v, want abnormal %q", cond, test.abnormal)
+			}
+		})
+	}
+
+	c, _ := newTestController(t, false)
+	for _, id := range []string{"default/unknown", "malformed"} {
+		if _, err := c.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: id}); status.Code(err) != codes.NotFound {
+			t.Errorf("ControllerGetVolume(%q) = %v, want NotFound", id, err)
+		}
+	}
+}
+
+// TestVolumeConditionPerNodeAccess checks that a volume with per-node access
+// is abnormal unless access is granted to every node it is published to.
+func TestVolumeConditionPerNodeAccess(t *testing.T) {
+	br, _ := grantedVolume("vol")
+	bar := func(node string, granted bool) *v1alpha1.BucketAccessRequest {
+		return &v1alpha1.BucketAccessRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      nodeBARName("vol", node),
+				Namespace: "default",
+				Labels:    map[string]string{provisionerLabel: "driver", volumeLabel: "vol"},
+			},
+			Status: v1alpha1.BucketAccessRequestStatus{AccessGranted: granted},
+		}
+	}
+	c, _ := newTestController(t, true, br, bar("node-a", true), bar("node-b", false))
+	if cond := c.volumeCondition(context.Background(), br); !cond.GetAbnormal() || !strings.Contains(cond.GetMessage(), nodeBARName("vol", "node-b")) {
+		t.Errorf("condition = %v, want abnormal for node-b", cond)
+	}
+}
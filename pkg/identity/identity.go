@@ -20,22 +20,38 @@ import (
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 )
 
-func NewIdentityServer(ident, version string, manifest map[string]string) (csi.IdentityServer, error) {
+// NewIdentityServer returns an IdentityServer whose Probe reports readiness,
+// or is always ready if readiness is nil. Plugin capabilities are derived
+// from the controller and node servers registered alongside it, either of
+// which may be nil, and from topology, set if the driver is configured to
+// report node topology.
+func NewIdentityServer(ident, version string, manifest map[string]string, readiness *Readiness, topology bool, cs csi.ControllerServer, ns csi.NodeServer) (csi.IdentityServer, error) {
 	return &IdentityServer{
-		Identity: ident,
-		Version:  version,
-		Manifest: manifest,
+		Identity:   ident,
+		Version:    version,
+		Manifest:   manifest,
+		Readiness:  readiness,
+		Topology:   topology,
+		controller: cs,
+		node:       ns,
 	}, nil
 }
 
 type IdentityServer struct {
-	Identity string
-	Version  string
-	Manifest map[string]string
+	Identity  string
+	Version   string
+	Manifest  map[string]string
+	Readiness *Readiness
+	Topology  bool
+
+	controller csi.ControllerServer
+	node       csi.NodeServer
 }
 
 func (i *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
@@ -50,13 +66,68 @@ func (i *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginIn
 	return &csi.GetPluginInfoResponse{
 		Name:          i.Identity,
 		VendorVersion: i.Version,
+		Manifest:      i.Manifest,
 	}, nil
 }
 
 func (i *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	if i.Readiness == nil {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+	}
+	ready, msg := i.Readiness.Ready()
+	if !ready {
+		klog.V(4).Infof("probe: not ready: %s", msg)
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: ready}}, nil
 }
 
 func (i *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	return &csi.GetPluginCapabilitiesResponse{}, nil
+	var services []csi.PluginCapability_Service_Type
+	expansion := false
+
+	if i.Topology {
+		services = append(services, csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS)
+	}
+
+	if i.controller != nil {
+		services = append(services, csi.PluginCapability_Service_CONTROLLER_SERVICE)
+		resp, err := i.controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get controller capabilities: %v", err)
+		}
+		for _, c := range resp.GetCapabilities() {
+			if c.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_EXPAND_VOLUME {
+				expansion = true
+			}
+		}
+	}
+
+	if i.node != nil {
+		resp, err := i.node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get node capabilities: %v", err)
+		}
+		for _, c := range resp.GetCapabilities() {
+			if c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_EXPAND_VOLUME {
+				expansion = true
+			}
+		}
+	}
+
+	var caps []*csi.PluginCapability
+	for _, t := range services {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{Type: t},
+			},
+		})
+	}
+	if expansion {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: csi.PluginCapability_VolumeExpansion_ONLINE},
+			},
+		})
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: caps}, nil
 }
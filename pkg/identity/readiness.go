@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package identity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	cs "github.com/container-object-storage-interface/api/clientset/typed/objectstorage.k8s.io/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+// requiredResources are the COSI resources the driver reads.
+var requiredResources = []string{"buckets", "bucketaccesses", "bucketrequests", "bucketaccessrequests"}
+
+// Readiness caches whether the API server is reachable through both the
+// kube and COSI clients and serves the COSI CRDs, refreshing it in the background.
+type Readiness struct {
+	kubeClient kubernetes.Interface
+	cosiClient cs.ObjectstorageV1alpha1Interface
+	interval   time.Duration
+	timeout    time.Duration
+
+	lock    sync.RWMutex
+	ready   bool
+	message string
+}
+
+// NewReadiness returns a Readiness that is not ready until Run has checked
+// the API server. Its clients are built from a copy of config whose requests
+// time out after interval, as discovery takes no context.
+func NewReadiness(config *rest.Config, interval time.Duration) (*Readiness, error) {
+	config = rest.CopyConfig(config)
+	config.Timeout = interval
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+	c, err := cs.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create COSI client: %v", err)
+	}
+	return &Readiness{
+		kubeClient: kube,
+		cosiClient: c,
+		interval:   interval,
+		timeout:    interval,
+		message:    "API server not checked yet",
+	}, nil
+}
+
+// Run checks the API server every interval until stopCh is closed.
+func (r *Readiness) Run(stopCh <-chan struct{}) {
+	wait.Until(r.check, r.interval, stopCh)
+}
+
+// Ready returns the result of the last check and why it failed.
+func (r *Readiness) Ready() (bool, string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.ready, r.message
+}
+
+func (r *Readiness) check() {
+	err := r.probe()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		if r.ready || r.message != err.Error() {
+			klog.Warningf("driver not ready: %v", err)
+		}
+		r.ready, r.message = false, err.Error()
+		return
+	}
+	if !r.ready {
+		klog.Info("driver ready")
+	}
+	r.ready, r.message = true, ""
+}
+
+func (r *Readiness) probe() error {
+	gv := v1alpha1.SchemeGroupVersion.String()
+	resources, err := r.kubeClient.Discovery().ServerResourcesForGroupVersion(gv)
+	if err != nil {
+		return fmt.Errorf("failed to discover %s resources: %v", gv, err)
+	}
+	served := make(map[string]bool, len(resources.APIResources))
+	for _, res := range resources.APIResources {
+		served[res.Name] = true
+	}
+	var missing []string
+	for _, res := range requiredResources {
+		if !served[res] {
+			missing = append(missing, res)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s resources not served: %s", gv, strings.Join(missing, ", "))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	if _, err := r.cosiClient.Buckets().List(ctx, metav1.ListOptions{Limit: 1}); err != nil {
+		return fmt.Errorf("failed to list buckets: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics defines the Prometheus metrics of the driver, registered
+// with the default registry.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "cosi"
+
+var (
+	operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "csi",
+		Name:      "operations_total",
+		Help:      "CSI calls served by method and gRPC status code.",
+	}, []string{"method", "code"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "csi",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of the CSI calls served by method and gRPC status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "node",
+		Name:      "api_lookup_duration_seconds",
+		Help:      "Latency of the objects read from the API server by resource.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resource"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "node",
+		Name:      "cache_lookups_total",
+		Help:      "Lookups of objects in the informer caches by resource and result, hit or miss.",
+	}, []string{"resource", "result"})
+
+	mountedVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "node",
+		Name:      "mounted_volumes",
+		Help:      "Volumes mounted at publish target paths since the driver started.",
+	})
+
+	credentialRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "node",
+		Name:      "credential_refreshes_total",
+		Help:      "Refreshes of expiring credentials by result, success or failure.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(operations, operationDuration, lookupDuration, cacheLookups, mountedVolumes, credentialRefreshes)
+}
+
+// UnaryServerInterceptor counts and times every call by method and status code.
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err).String()
+	operations.WithLabelValues(info.FullMethod, code).Inc()
+	operationDuration.WithLabelValues(info.FullMethod, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// ObserveLookup records the latency of reading resource from the API server
+// since start.
+func ObserveLookup(resource string, start time.Time) {
+	lookupDuration.WithLabelValues(resource).Observe(time.Since(start).Seconds())
+}
+
+// RecordCacheLookup counts a lookup of resource in an informer cache.
+func RecordCacheLookup(resource string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(resource, result).Inc()
+}
+
+// SetMountedVolumes sets the number of mounted volumes.
+func SetMountedVolumes(n int) {
+	mountedVolumes.Set(float64(n))
+}
+
+// RecordCredentialRefresh counts a credential refresh that failed with err, if set.
+func RecordCredentialRefresh(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	credentialRefreshes.WithLabelValues(result).Inc()
+}
+
+// Handler serves the metrics of the default registry.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
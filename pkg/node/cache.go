@@ -0,0 +1,138 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"time"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-object-storage-interface/api/clientset"
+	cs "github.com/container-object-storage-interface/api/clientset/typed/objectstorage.k8s.io/v1alpha1"
+	cosiinformers "github.com/container-object-storage-interface/api/informers/externalversions"
+	cosilisters "github.com/container-object-storage-interface/api/listers/objectstorage.k8s.io/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/metrics"
+)
+
+// objectCache serves the objects read while staging volumes from informer
+// caches. A nil *objectCache misses every lookup, so callers always fall
+// back to live GETs, which they also do while the caches sync.
+type objectCache struct {
+	cosiFactory cosiinformers.SharedInformerFactory
+	podFactory  informers.SharedInformerFactory
+
+	bars    cosilisters.BucketAccessRequestLister
+	bas     cosilisters.BucketAccessLister
+	brs     cosilisters.BucketRequestLister
+	buckets cosilisters.BucketLister
+	pods    corelisters.PodLister
+}
+
+// newObjectCache returns a cache of the COSI objects and of the pods
+// scheduled to nodeID.
+func newObjectCache(c cs.ObjectstorageV1alpha1Client, kube kubernetes.Interface, nodeID string, resync time.Duration) *objectCache {
+	cosiFactory := cosiinformers.NewSharedInformerFactory(clientset.New(c.RESTClient()), resync)
+	podFactory := informers.NewSharedInformerFactoryWithOptions(kube, resync, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeID).String()
+	}))
+
+	objects := cosiFactory.Objectstorage().V1alpha1()
+	return &objectCache{
+		cosiFactory: cosiFactory,
+		podFactory:  podFactory,
+		bars:        objects.BucketAccessRequests().Lister(),
+		bas:         objects.BucketAccesses().Lister(),
+		brs:         objects.BucketRequests().Lister(),
+		buckets:     objects.Buckets().Lister(),
+		pods:        podFactory.Core().V1().Pods().Lister(),
+	}
+}
+
+// start runs the informers until stopCh is closed, without waiting for them
+// to sync.
+func (c *objectCache) start(stopCh <-chan struct{}) {
+	if c == nil {
+		return
+	}
+	c.cosiFactory.Start(stopCh)
+	c.podFactory.Start(stopCh)
+	go func() {
+		for typ, ok := range c.cosiFactory.WaitForCacheSync(stopCh) {
+			if !ok {
+				klog.Warningf("informer cache of %v did not sync", typ)
+			}
+		}
+		for typ, ok := range c.podFactory.WaitForCacheSync(stopCh) {
+			if !ok {
+				klog.Warningf("informer cache of %v did not sync", typ)
+			}
+		}
+		klog.Info("informer caches synced")
+	}()
+}
+
+func (c *objectCache) bucketAccessRequest(ns, name string) (*v1alpha1.BucketAccessRequest, bool) {
+	if c == nil {
+		return nil, false
+	}
+	bar, err := c.bars.BucketAccessRequests(ns).Get(name)
+	metrics.RecordCacheLookup("bucketAccessRequest", err == nil)
+	return bar, err == nil
+}
+
+func (c *objectCache) bucketAccess(name string) (*v1alpha1.BucketAccess, bool) {
+	if c == nil {
+		return nil, false
+	}
+	ba, err := c.bas.Get(name)
+	metrics.RecordCacheLookup("bucketAccess", err == nil)
+	return ba, err == nil
+}
+
+func (c *objectCache) bucketRequest(ns, name string) (*v1alpha1.BucketRequest, bool) {
+	if c == nil {
+		return nil, false
+	}
+	br, err := c.brs.BucketRequests(ns).Get(name)
+	metrics.RecordCacheLookup("bucketRequest", err == nil)
+	return br, err == nil
+}
+
+func (c *objectCache) bucket(name string) (*v1alpha1.Bucket, bool) {
+	if c == nil {
+		return nil, false
+	}
+	bkt, err := c.buckets.Get(name)
+	metrics.RecordCacheLookup("bucket", err == nil)
+	return bkt, err == nil
+}
+
+func (c *objectCache) pod(ns, name string) (*v1.Pod, bool) {
+	if c == nil {
+		return nil, false
+	}
+	pod, err := c.pods.Pods(ns).Get(name)
+	metrics.RecordCacheLookup("pod", err == nil)
+	return pod, err == nil
+}
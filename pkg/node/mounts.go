@@ -0,0 +1,48 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"sync"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/metrics"
+)
+
+// mountTracker keeps the publish target paths mounted since the driver
+// started, so that repeated publish and unpublish calls count once.
+type mountTracker struct {
+	lock  sync.Mutex
+	paths map[string]bool
+}
+
+func newMountTracker() *mountTracker {
+	return &mountTracker{paths: make(map[string]bool)}
+}
+
+func (t *mountTracker) add(path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.paths[path] = true
+	metrics.SetMountedVolumes(len(t.paths))
+}
+
+func (t *mountTracker) remove(path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.paths, path)
+	metrics.SetMountedVolumes(len(t.paths))
+}
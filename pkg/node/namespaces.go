@@ -0,0 +1,55 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"sync"
+)
+
+// namespaceFilter restricts the namespaces of the bucketAccessRequests a node
+// stages. It can be replaced while requests are served.
+type namespaceFilter struct {
+	lock    sync.RWMutex
+	allowed map[string]bool
+}
+
+func newNamespaceFilter(namespaces []string) *namespaceFilter {
+	f := &namespaceFilter{}
+	f.set(namespaces)
+	return f
+}
+
+// set allows only namespaces, or every namespace if it is empty.
+func (f *namespaceFilter) set(namespaces []string) {
+	var allowed map[string]bool
+	if len(namespaces) > 0 {
+		allowed = make(map[string]bool, len(namespaces))
+		for _, ns := range namespaces {
+			allowed[ns] = true
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.allowed = allowed
+}
+
+func (f *namespaceFilter) allows(ns string) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.allowed == nil || f.allowed[ns]
+}
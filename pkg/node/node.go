@@ -2,35 +2,86 @@ package node
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"io/ioutil"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 	"k8s.io/utils/mount"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf8"
 
 	cs "github.com/container-object-storage-interface/api/clientset/typed/objectstorage.k8s.io/v1alpha1"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/capability"
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/connection"
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/metrics"
 )
 
 var _ csi.NodeServer = &NodeServer{}
-const protocolFileName string = `protocolConn.json`
+const protocolFileName string = connection.FileName
 var getError = func(t, n string, e error) error { return fmt.Errorf("failed to get <%s>%s: %v", t, n, e) }
 
-func NewNodeServer(driverName, nodeID string, c cs.ObjectstorageV1alpha1Client, kube kubernetes.Interface) csi.NodeServer {
+// Config holds the tunables of a NodeServer.
+type Config struct {
+	// RefreshFraction is the fraction of the remaining lifetime of expiring
+	// credentials after which they are refreshed.
+	RefreshFraction float64
+	// LegacyEncoding writes the connection file of earlier releases instead:
+	// the bucket's protocol section under "protocol" and the base64 encoded
+	// Secret data under "connection".
+	LegacyEncoding bool
+	// TopologyLabels are the labels of the node object published as its
+	// accessible topology.
+	TopologyLabels []string
+	// Topology are static segments added to the accessible topology.
+	Topology map[string]string
+	// APITimeout bounds every API call, 0 leaves only the deadline of the request.
+	APITimeout time.Duration
+	// Cache serves lookups from informer caches, resynced every CacheResync.
+	Cache       bool
+	CacheResync time.Duration
+	// AllowedNamespaces are the only namespaces whose bucketAccessRequests
+	// are staged, all are allowed if empty.
+	AllowedNamespaces []string
+	// TmpfsSize is the size in bytes of a tmpfs mounted at every staging
+	// path, 0 writes to the staging path as is.
+	TmpfsSize int64
+	// GCInterval is how often refreshes of volumes whose staging path is
+	// gone are cancelled, 0 never.
+	GCInterval time.Duration
+	// MaxVolumesPerNode limits the volumes kubelet places on the node, 0 is unlimited.
+	MaxVolumesPerNode int64
+}
+
+// NewNodeServer returns a NodeServer for the node nodeID tuned by config.
+func NewNodeServer(driverName, nodeID string, c cs.ObjectstorageV1alpha1Client, kube kubernetes.Interface, config Config) *NodeServer {
+	var cache *objectCache
+	if config.Cache {
+		cache = newObjectCache(c, kube, nodeID, config.CacheResync)
+	}
 	return &NodeServer{
 		name:       driverName,
 		nodeID:     nodeID,
 		cosiClient: c,
-		ctx:        context.Background(),
 		kubeClient: kube,
+		refresher:  newCredentialRefresher(config.RefreshFraction),
+		config:     config,
+		cache:      cache,
+		namespaces: newNamespaceFilter(config.AllowedNamespaces),
+		mounts:     newMountTracker(),
 	}
 }
 
@@ -48,12 +99,45 @@ type NodeServer struct {
 	nodeID     string
 	cosiClient cs.ObjectstorageV1alpha1Client
 	kubeClient kubernetes.Interface
-	ctx        context.Context
+	refresher  *credentialRefresher
+	config     Config
+	cache      *objectCache
+	namespaces *namespaceFilter
+	mounts     *mountTracker
+}
+
+// Start runs the informers and the garbage collection of refreshes until
+// stopCh is closed.
+func (n NodeServer) Start(stopCh <-chan struct{}) {
+	n.cache.start(stopCh)
+	if n.config.GCInterval > 0 {
+		go wait.Until(n.refresher.collect, n.config.GCInterval, stopCh)
+	}
+}
+
+// SetAllowedNamespaces replaces Config.AllowedNamespaces of a running server.
+func (n NodeServer) SetAllowedNamespaces(namespaces []string) {
+	n.namespaces.set(namespaces)
+}
+
+// Stop cancels the pending credential refreshes, to be called once no more
+// requests are served.
+func (n NodeServer) Stop() {
+	n.refresher.stop()
 }
 
-func (n NodeServer) getBAR(barName, barNs string) (*v1alpha1.BucketAccessRequest, error)  {
+func (n NodeServer) getBAR(ctx context.Context, barName, barNs string) (*v1alpha1.BucketAccessRequest, error)  {
 	klog.Infof("getting bucketAccessRequest %q", fmt.Sprintf("%s/%s", barNs, barName))
-	bar, err := n.cosiClient.BucketAccessRequests(barNs).Get(n.ctx, barName, metav1.GetOptions{})
+	bar, cached := n.cache.bucketAccessRequest(barNs, barName)
+	var err error
+	if !cached || !bar.Status.AccessGranted {
+		// the cache may lag behind the grant
+		ctx, cancel := n.apiContext(ctx)
+		defer cancel()
+		start := time.Now()
+		bar, err = n.cosiClient.BucketAccessRequests(barNs).Get(ctx, barName, metav1.GetOptions{})
+		metrics.ObserveLookup("bucketAccessRequest", start)
+	}
 	if err != nil || bar == nil || !bar.Status.AccessGranted {
 		return nil, logErr(getError("bucketAccessRequest", fmt.Sprintf("%s/%s", barNs, barName), err))
 	}
@@ -63,116 +147,387 @@ func (n NodeServer) getBAR(barName, barNs string) (*v1alpha1.BucketAccessRequest
 	return bar, nil
 }
 
-func (n NodeServer) getBA(baName string) (*v1alpha1.BucketAccess, error)  {
+func (n NodeServer) getBA(ctx context.Context, baName string) (*v1alpha1.BucketAccess, error)  {
 	klog.Infof("getting bucketAccess %q", fmt.Sprintf("%s", baName))
-	ba, err := n.cosiClient.BucketAccesses().Get(n.ctx, baName, metav1.GetOptions{})
+	ba, cached := n.cache.bucketAccess(baName)
+	var err error
+	if !cached || !ba.Status.AccessGranted {
+		ctx, cancel := n.apiContext(ctx)
+		defer cancel()
+		start := time.Now()
+		ba, err = n.cosiClient.BucketAccesses().Get(ctx, baName, metav1.GetOptions{})
+		metrics.ObserveLookup("bucketAccess", start)
+	}
 	if err != nil || ba == nil || !ba.Status.AccessGranted {
 		return nil, logErr(getError("bucketAccess", fmt.Sprintf("%s", baName), err))
 	}
 	return ba, nil
 }
 
-func (n NodeServer) getBR(brName, brNs string) (*v1alpha1.BucketRequest, error)  {
+func (n NodeServer) getBR(ctx context.Context, brName, brNs string) (*v1alpha1.BucketRequest, error)  {
 	klog.Infof("getting bucketRequest %q", brName)
-	br, err := n.cosiClient.BucketRequests(brNs).Get(n.ctx, brName, metav1.GetOptions{})
+	br, cached := n.cache.bucketRequest(brNs, brName)
+	var err error
+	if !cached || !br.Status.BucketAvailable {
+		ctx, cancel := n.apiContext(ctx)
+		defer cancel()
+		start := time.Now()
+		br, err = n.cosiClient.BucketRequests(brNs).Get(ctx, brName, metav1.GetOptions{})
+		metrics.ObserveLookup("bucketRequest", start)
+	}
 	if err != nil || br == nil || !br.Status.BucketAvailable {
 		return nil, logErr(getError("bucketRequest", fmt.Sprintf("%s/%s", brNs, brName), err))
 	}
 	return br, nil
 }
 
-func (n NodeServer) getB(bName string)  (*v1alpha1.Bucket, error) {
+func (n NodeServer) getB(ctx context.Context, bName string)  (*v1alpha1.Bucket, error) {
 	klog.Infof("getting bucket %q", bName)
 	// is BucketInstanceName the correct field, or should it be BucketClass
-	bkt, err := n.cosiClient.Buckets().Get(n.ctx, bName, metav1.GetOptions{})
+	bkt, cached := n.cache.bucket(bName)
+	var err error
+	if !cached || !bkt.Status.BucketAvailable {
+		ctx, cancel := n.apiContext(ctx)
+		defer cancel()
+		start := time.Now()
+		bkt, err = n.cosiClient.Buckets().Get(ctx, bName, metav1.GetOptions{})
+		metrics.ObserveLookup("bucket", start)
+	}
 	if err != nil || bkt == nil || !bkt.Status.BucketAvailable {
 		return nil, logErr(getError("bucket", bName, err))
 	}
 	return bkt, nil
 }
 
+func (n NodeServer) getSecret(ctx context.Context, secretName, secretNs string) (*v1.Secret, error) {
+	ctx, cancel := n.apiContext(ctx)
+	defer cancel()
+	start := time.Now()
+	secret, err := n.kubeClient.CoreV1().Secrets(secretNs).Get(ctx, secretName, metav1.GetOptions{})
+	metrics.ObserveLookup("secret", start)
+	if err != nil {
+		return nil, logErr(getError("secret", fmt.Sprintf("%s/%s", secretNs, secretName), err))
+	}
+	return secret, nil
+}
+
+// apiContext bounds a single API call made while serving ctx by the
+// configured timeout.
+func (n NodeServer) apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if n.config.APITimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, n.config.APITimeout)
+}
+
 func (n NodeServer) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	klog.Infof("NodePublishVolume: volId: %v, targetPath: %v\n", request.GetVolumeId(), request.StagingTargetPath)
 
-	name, ns, err := parseVolumeContext(request.VolumeContext)
+	if err := capability.Validate([]*csi.VolumeCapability{request.GetVolumeCapability()}); err != nil {
+		return nil, logErr(status.Error(codes.InvalidArgument, err.Error()))
+	}
+
+	barName, barNs, err := n.resolveBAR(ctx, request.PublishContext, request.VolumeContext)
 	if err != nil {
 		return nil, err
 	}
 
+	if !n.namespaces.allows(barNs) {
+		return nil, logErr(status.Errorf(codes.PermissionDenied, "bucketAccessRequest %s/%s is in a namespace not allowed on this node", barNs, barName))
+	}
 
-	pod, err := n.kubeClient.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+	volumeID := request.GetVolumeId()
+	stagingTargetPath := request.GetStagingTargetPath()
+	unlock := n.refresher.lockVolume(volumeID)
+	defer unlock()
+	if n.config.TmpfsSize > 0 {
+		if err := mountTmpfs(stagingTargetPath, n.config.TmpfsSize); err != nil {
+			return nil, logErr(status.Error(codes.Internal, err.Error()))
+		}
+	}
+	expiration, err := n.stage(ctx, barName, barNs, stagingTargetPath)
 	if err != nil {
-		return nil, logErr(getError("pod", fmt.Sprintf("%s/%s", ns, name), err))
+		return nil, err
 	}
 
-	barName, barNs, err := parsePod(pod, n.name)
+	if expiration.IsZero() {
+		n.refresher.cancel(volumeID)
+	} else {
+		n.scheduleRefresh(volumeID, barName, barNs, stagingTargetPath, expiration)
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// scheduleRefresh re-stages the volume from the bucketAccessRequest before
+// its credentials expire.
+func (n NodeServer) scheduleRefresh(volumeID, barName, barNs, stagingTargetPath string, expiration time.Time) {
+	n.refresher.schedule(volumeID, stagingTargetPath, expiration, func() (time.Time, error) {
+		return n.stage(context.Background(), barName, barNs, stagingTargetPath)
+	})
+}
+
+// volumeCondition reports the credential condition of volumeID. Kubelet does
+// not stage volumes again when the driver restarts, so the refresh of a
+// volume staged before is resumed from the files in its staging path.
+func (n NodeServer) volumeCondition(volumeID, stagingTargetPath string) *csi.VolumeCondition {
+	if stagingTargetPath == "" || n.refresher.tracked(volumeID) {
+		return n.refresher.condition(volumeID)
+	}
+	unlock := n.refresher.lockVolume(volumeID)
+	defer unlock()
+	if n.refresher.tracked(volumeID) {
+		// staged meanwhile
+		return n.refresher.condition(volumeID)
+	}
+
+	expiration, err := readExpiration(stagingTargetPath)
 	if err != nil {
-		return nil, err
+		klog.Error(err)
+		return &csi.VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	if expiration.IsZero() {
+		return n.refresher.condition(volumeID)
 	}
-	bar, err := n.getBAR(barName, barNs)
+	staged, err := readStagedVolume(stagingTargetPath)
 	if err != nil {
-		return nil, err
+		// staged by an earlier release, which did not record its bucketAccessRequest
+		klog.Warningf("cannot refresh credentials of volume %q: %v", volumeID, err)
+		return unrefreshedCondition(expiration)
+	}
+	klog.Infof("resuming credential refresh of volume %q", volumeID)
+	n.scheduleRefresh(volumeID, staged.BARName, staged.BARNamespace, stagingTargetPath, expiration)
+	return n.refresher.condition(volumeID)
+}
+
+// resolveBAR returns the bucketAccessRequest named in the publish context of
+// a volume with per-node access, the volume context of a provisioned volume,
+// or else in the inline volume of the pod.
+func (n NodeServer) resolveBAR(ctx context.Context, publishCtx, volCtx map[string]string) (name, ns string, err error) {
+	for _, c := range []map[string]string{publishCtx, volCtx} {
+		if name, ns := c[barNameKey], c[barNamespaceKey]; name != "" && ns != "" {
+			return name, ns, nil
+		}
 	}
-	ba, err := n.getBA(bar.Spec.BucketAccessName)
+
+	podName, podNs, err := parseVolumeContext(volCtx)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
-	br, err := n.getBR(bar.Spec.BucketRequestName, barNs)
+	pod, cached := n.cache.pod(podNs, podName)
+	if !cached {
+		apiCtx, cancel := n.apiContext(ctx)
+		defer cancel()
+		start := time.Now()
+		pod, err = n.kubeClient.CoreV1().Pods(podNs).Get(apiCtx, podName, metav1.GetOptions{})
+		metrics.ObserveLookup("pod", start)
+		if err != nil {
+			return "", "", logErr(getError("pod", fmt.Sprintf("%s/%s", podNs, podName), err))
+		}
+	}
+	return parsePod(pod, n.name)
+}
+
+// stage resolves the COSI objects referenced by the bucketAccessRequest and
+// writes their connection data into stagingTargetPath. It returns the
+// expiration of the written credentials, or a zero time if they do not expire.
+func (n NodeServer) stage(ctx context.Context, barName, barNs, stagingTargetPath string) (time.Time, error) {
+	bar, err := n.getBAR(ctx, barName, barNs)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
-	bkt, err := n.getB(br.Spec.BucketInstanceName)
+	ba, err := n.getBA(ctx, bar.Spec.BucketAccessName)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
+	}
+	br, err := n.getBR(ctx, bar.Spec.BucketRequestName, barNs)
+	if err != nil {
+		return time.Time{}, err
 	}
-	secret, err := n.kubeClient.CoreV1().Secrets(barNs).Get(ctx, ba.Spec.MintedSecretName, metav1.GetOptions{})
+	bkt, err := n.getB(ctx, br.Spec.BucketInstanceName)
 	if err != nil {
-		return nil, logErr(getError("pod", fmt.Sprintf("%s/%s", barNs, ba.Spec.MintedSecretName), err))
+		return time.Time{}, err
 	}
-	var protocolConnection interface{}
-	switch bkt.Spec.Protocol.ProtocolName {
+	secret, err := n.getSecret(ctx, ba.Spec.MintedSecretName, barNs)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := validateProtocol(bkt); err != nil {
+		return time.Time{}, logErr(err)
+	}
+	klog.Infof("bucket %q has protocol %q", bkt.Name, bkt.Spec.Protocol.ProtocolName)
+
+	conn := &connection.Connection{
+		APIVersion: connection.APIVersion,
+		Kind:       connection.Kind,
+		Protocol: connection.Protocol{
+			Name: connection.ProtocolName(bkt.Spec.Protocol.ProtocolName),
+		},
+		Bucket: connection.Bucket{
+			Name:                   bkt.Name,
+			BucketRequestName:      br.Name,
+			BucketRequestNamespace: br.Namespace,
+			BucketClassName:        bkt.Spec.BucketClassName,
+		},
+	}
+	if conn.Bucket.BucketClassName == "" {
+		conn.Bucket.BucketClassName = br.Spec.BucketClassName
+	}
+	switch p := bkt.Spec.Protocol; p.ProtocolName {
 	case v1alpha1.ProtocolNameS3:
-		protocolConnection = bkt.Spec.Protocol.S3
+		conn.Protocol.Version = p.S3.Version
+		conn.Protocol.S3 = &connection.S3{
+			Endpoint:         p.S3.Endpoint,
+			BucketName:       p.S3.BucketName,
+			Region:           p.S3.Region,
+			SignatureVersion: string(p.S3.SignatureVersion),
+		}
 	case v1alpha1.ProtocolNameAzure:
-		protocolConnection = bkt.Spec.Protocol.AzureBlob
+		conn.Protocol.AzureBlob = &connection.AzureBlob{
+			StorageAccount: p.AzureBlob.StorageAccount,
+			ContainerName:  p.AzureBlob.ContainerName,
+		}
 	case v1alpha1.ProtocolNameGCS:
-		protocolConnection = bkt.Spec.Protocol.GCS
-	case "":
-		err = fmt.Errorf("bucket %q protocol not signature")
-	default:
-		err = fmt.Errorf("unrecognized protocol %q, unable to extract connection data", bkt.Spec.Protocol)
+		conn.Protocol.GCS = &connection.GCS{
+			BucketName:     p.GCS.BucketName,
+			ProjectID:      p.GCS.ProjectID,
+			ServiceAccount: p.GCS.ServiceAccount,
+			PrivateKeyName: p.GCS.PrivateKeyName,
+		}
+	}
+
+	conn.Credentials, conn.Base64Credentials = decodeCredentials(secret)
+	if err := conn.Validate(); err != nil {
+		return time.Time{}, logErr(fmt.Errorf("bucket %q: %v", bkt.Name, err))
+	}
+
+	expiration, err := parseExpiration(ba, secret)
+	if err != nil {
+		return time.Time{}, logErr(err)
 	}
 
+	var protoData []byte
+	if n.config.LegacyEncoding {
+		protoData, err = json.Marshal(legacyConnection(bkt, secret))
+	} else {
+		protoData, err = json.Marshal(conn)
+	}
 	if err != nil {
-		return nil, logErr(err)
+		return time.Time{}, logErr(fmt.Errorf("error marshalling protocol: %v", err))
 	}
-	klog.Infof("bucket %q has protocol %q", bkt.Name, bkt.Spec.Protocol)
 
-	data := make(map[string]interface{})
-	data["protocol"] = protocolConnection
-	data["connection"] = secret.Data
+	if err := writeFile(stagingTargetPath, protocolFileName, protoData); err != nil {
+		return time.Time{}, logErr(err)
+	}
 
-	protoData, err := json.Marshal(data)
+	if expiration.IsZero() {
+		for _, name := range []string{expirationFileName, stagedFileName} {
+			if err := removeFile(stagingTargetPath, name); err != nil {
+				return time.Time{}, logErr(err)
+			}
+		}
+		return expiration, nil
+	}
+	klog.Infof("credentials for bucketAccess %q expire at %s", ba.Name, expiration.Format(time.RFC3339))
+	stagedData, err := json.Marshal(&stagedVolume{BARName: barName, BARNamespace: barNs})
 	if err != nil {
-		return nil, logErr(fmt.Errorf("error marshalling protocol: %v", err))
+		return time.Time{}, logErr(fmt.Errorf("error marshalling staged volume: %v", err))
+	}
+	if err := writeFile(stagingTargetPath, stagedFileName, stagedData); err != nil {
+		return time.Time{}, logErr(err)
 	}
+	if err := writeFile(stagingTargetPath, expirationFileName, []byte(expiration.Format(time.RFC3339)+"\n")); err != nil {
+		return time.Time{}, logErr(err)
+	}
+	return expiration, nil
+}
 
-	target := filepath.Join(request.StagingTargetPath, protocolFileName)
+// legacyConnection returns the connection file written by earlier releases,
+// which encodes the Secret data as base64 like any []byte.
+func legacyConnection(bkt *v1alpha1.Bucket, secret *v1.Secret) map[string]interface{} {
+	var protocol interface{}
+	switch p := bkt.Spec.Protocol; p.ProtocolName {
+	case v1alpha1.ProtocolNameS3:
+		protocol = p.S3
+	case v1alpha1.ProtocolNameAzure:
+		protocol = p.AzureBlob
+	case v1alpha1.ProtocolNameGCS:
+		protocol = p.GCS
+	}
+	return map[string]interface{}{
+		"protocol":   protocol,
+		"connection": secret.Data,
+	}
+}
+
+// decodeCredentials returns the minted Secret data as strings, base64
+// encoding values that are not valid UTF-8. The keys of base64 encoded values
+// are returned sorted.
+func decodeCredentials(secret *v1.Secret) (map[string]string, []string) {
+	creds := make(map[string]string, len(secret.Data))
+	var encoded []string
+	for k, v := range secret.Data {
+		if utf8.Valid(v) {
+			creds[k] = string(v)
+			continue
+		}
+		klog.Infof("secret %s/%s key %q is binary, writing it base64 encoded", secret.Namespace, secret.Name, k)
+		creds[k] = base64.StdEncoding.EncodeToString(v)
+		encoded = append(encoded, k)
+	}
+	sort.Strings(encoded)
+	return creds, encoded
+}
+
+// writeFile atomically replaces dir/name with data, so that a refresh never
+// exposes a partially written file to the pod.
+func writeFile(dir, name string, data []byte) error {
+	target := filepath.Join(dir, name)
 	klog.Infof("creating conn file: %s", target)
-	f, err := os.Open(target)
+	f, err := ioutil.TempFile(dir, "."+name)
 	if err != nil {
-		return nil, logErr(fmt.Errorf("error creating file: %s: %v", target, err))
+		return fmt.Errorf("error creating file: %s: %v", target, err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	defer f.Close()
-	_, err = f.Write(protoData)
 	if err != nil {
-		return nil, logErr(fmt.Errorf("unable to write to file: %v", err))
+		return fmt.Errorf("unable to write to file: %v", err)
 	}
-	return &csi.NodeStageVolumeResponse{}, nil
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("unable to set mode of file %s: %v", target, err)
+	}
+	if err := os.Rename(f.Name(), target); err != nil {
+		return fmt.Errorf("unable to replace file %s: %v", target, err)
+	}
+	return nil
+}
+
+func removeFile(dir, name string) error {
+	target := filepath.Join(dir, name)
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove file %s: %v", target, err)
+	}
+	return nil
 }
 
 func (n NodeServer) NodeUnstageVolume(ctx context.Context, request *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	panic("implement me")
+	klog.Infof("NodeUnstageVolume: volId: %v, stagingTargetPath: %v\n", request.GetVolumeId(), request.GetStagingTargetPath())
+	// waits for a refresh in progress, which then finds the volume unscheduled
+	unlock := n.refresher.lockVolume(request.GetVolumeId())
+	defer unlock()
+	n.refresher.cancel(request.GetVolumeId())
+	for _, name := range []string{protocolFileName, expirationFileName, stagedFileName} {
+		if err := removeFile(request.GetStagingTargetPath(), name); err != nil {
+			return nil, logErr(err)
+		}
+	}
+	// also unmount a tmpfs mounted before TmpfsSize was unset
+	if err := unmountTmpfs(request.GetStagingTargetPath()); err != nil {
+		return nil, logErr(status.Error(codes.Internal, err.Error()))
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 const (
@@ -236,13 +591,22 @@ func (n NodeServer) NodePublishVolume(ctx context.Context, request *csi.NodePubl
 		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
 	}
 
+	if err := capability.Validate([]*csi.VolumeCapability{request.GetVolumeCapability()}); err != nil {
+		return nil, logErr(status.Error(codes.InvalidArgument, err.Error()))
+	}
+
 	if err := os.MkdirAll(targetPath, 0755); err != nil {
 		return nil, status.Errorf(codes.Internal, "Stage Volume Failed: %v", err)
 	}
 
-	if err := mount.New("").Mount(stagingTargetPath, targetPath, "", []string{"bind"}); err != nil {
+	options := []string{"bind"}
+	if request.GetReadonly() || capability.ReadOnly(request.GetVolumeCapability()) {
+		options = append(options, "ro")
+	}
+	if err := mount.New("").Mount(stagingTargetPath, targetPath, "", options); err != nil {
 		return nil, status.Errorf(codes.Internal, "Stage Volume Mount Failed: %v", err)
 	}
+	n.mounts.add(targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -257,11 +621,28 @@ func (n NodeServer) NodeUnpublishVolume(ctx context.Context, request *csi.NodeUn
 		}
 		return nil, logErr(fmt.Errorf("unable to remove file %s: %v", target, err))
 	}
+	n.mounts.remove(request.GetTargetPath())
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (n NodeServer) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	panic("implement me")
+	if request.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	if _, err := os.Stat(request.GetVolumePath()); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s not found", request.GetVolumePath())
+		}
+		return nil, status.Errorf(codes.Internal, "unable to stat volume path %s: %v", request.GetVolumePath(), err)
+	}
+	usage, err := volumeUsage(request.GetVolumePath())
+	if err != nil {
+		return nil, logErr(status.Error(codes.Internal, err.Error()))
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: n.volumeCondition(request.GetVolumeId(), request.GetStagingTargetPath()),
+	}, nil
 }
 
 func (n NodeServer) NodeExpandVolume(ctx context.Context, request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -269,13 +650,63 @@ func (n NodeServer) NodeExpandVolume(ctx context.Context, request *csi.NodeExpan
 }
 
 func (n NodeServer) NodeGetCapabilities(ctx context.Context, request *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	panic("implement me")
+	var caps []*csi.NodeServiceCapability
+	for _, c := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	} {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: c},
+			},
+		})
+	}
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
 func (n NodeServer) NodeGetInfo(ctx context.Context, request *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	klog.Infof("NodeGetInfo()")
 	resp := &csi.NodeGetInfoResponse{
-		NodeId: n.nodeID,
+		NodeId:            n.nodeID,
+		MaxVolumesPerNode: n.config.MaxVolumesPerNode,
+	}
+
+	segments, err := n.topology(ctx)
+	if err != nil {
+		return nil, logErr(status.Error(codes.Internal, err.Error()))
+	}
+	if len(segments) > 0 {
+		resp.AccessibleTopology = &csi.Topology{Segments: segments}
 	}
 	return resp, nil
 }
+
+// topology returns the configured static segments and the values of the
+// configured labels of the node object. Labels the node lacks are skipped,
+// so that a mislabeled node still registers.
+func (n NodeServer) topology(ctx context.Context) (map[string]string, error) {
+	segments := make(map[string]string, len(n.config.Topology)+len(n.config.TopologyLabels))
+	for k, v := range n.config.Topology {
+		segments[k] = v
+	}
+	if len(n.config.TopologyLabels) == 0 {
+		return segments, nil
+	}
+
+	apiCtx, cancel := n.apiContext(ctx)
+	defer cancel()
+	node, err := n.kubeClient.CoreV1().Nodes().Get(apiCtx, n.nodeID, metav1.GetOptions{})
+	if err != nil {
+		return nil, getError("node", n.nodeID, err)
+	}
+	for _, l := range n.config.TopologyLabels {
+		v, ok := node.Labels[l]
+		if !ok {
+			klog.Warningf("node %q has no topology label %q, leaving it out of the accessible topology", n.nodeID, l)
+			continue
+		}
+		segments[l] = v
+	}
+	return segments, nil
+}
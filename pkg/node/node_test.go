@@ -0,0 +1,163 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestLegacyConnection checks the shape of the connection file read by
+// consumers of earlier releases.
+func TestLegacyConnection(t *testing.T) {
+	bkt := &v1alpha1.Bucket{Spec: v1alpha1.BucketSpec{Protocol: v1alpha1.Protocol{
+		ProtocolName: v1alpha1.ProtocolNameS3,
+		S3:           &v1alpha1.S3Protocol{Endpoint: "https://s3.example.com", BucketName: "bucket"},
+	}}}
+	secret := &v1.Secret{Data: map[string][]byte{"accessKeyID": []byte("key")}}
+
+	data, err := json.Marshal(legacyConnection(bkt, secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("legacy connection has keys %v, want protocol and connection", got)
+	}
+	if got["protocol"]["endpoint"] != "https://s3.example.com" || got["protocol"]["bucketName"] != "bucket" {
+		t.Errorf("legacy protocol = %v, want the s3 section", got["protocol"])
+	}
+	if want := map[string]interface{}{"accessKeyID": "a2V5"}; !reflect.DeepEqual(got["connection"], want) {
+		t.Errorf("legacy connection = %v, want %v", got["connection"], want)
+	}
+}
+
+// TestTopologySkipsMissingLabels checks that a node lacking a topology label
+// still reports the remaining segments.
+func TestTopologySkipsMissingLabels(t *testing.T) {
+	kube := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node",
+		Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"},
+	}})
+	n := NodeServer{nodeID: "node", kubeClient: kube, config: Config{
+		Topology:       map[string]string{"topology.kubernetes.io/region": "region"},
+		TopologyLabels: []string{"topology.kubernetes.io/zone", "topology.kubernetes.io/rack"},
+	}}
+
+	got, err := n.topology(context.Background())
+	if err != nil {
+		t.Fatalf("topology() = %v", err)
+	}
+	want := map[string]string{
+		"topology.kubernetes.io/region": "region",
+		"topology.kubernetes.io/zone":   "zone-a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topology() = %v, want %v", got, want)
+	}
+}
+
+// TestNodeGetVolumeStats checks that stats carry the usage kubelet requires
+// next to the credential condition.
+func TestNodeGetVolumeStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := NodeServer{refresher: newCredentialRefresher(0.5)}
+
+	resp, err := n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol", VolumePath: dir})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats() = %v", err)
+	}
+	units := map[csi.VolumeUsage_Unit]bool{}
+	for _, u := range resp.GetUsage() {
+		units[u.GetUnit()] = true
+		if u.GetTotal() <= 0 {
+			t.Errorf("%v usage total = %d, want positive", u.GetUnit(), u.GetTotal())
+		}
+	}
+	if !units[csi.VolumeUsage_BYTES] || !units[csi.VolumeUsage_INODES] {
+		t.Errorf("NodeGetVolumeStats() usage = %v, want bytes and inodes", resp.GetUsage())
+	}
+	if resp.GetVolumeCondition() == nil {
+		t.Error("NodeGetVolumeStats() has no volume condition")
+	}
+
+	_, err = n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol", VolumePath: filepath.Join(dir, "missing")})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("NodeGetVolumeStats() of a missing path = %v, want NotFound", err)
+	}
+}
+
+// TestVolumeConditionAfterRestart checks that the refresh of a volume staged
+// before the driver restarted is resumed from its staging path, and that the
+// expiration is still reported when it cannot be.
+func TestVolumeConditionAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := NodeServer{refresher: newCredentialRefresher(0.5)}
+	defer n.refresher.stop()
+
+	if c := n.volumeCondition("vol", dir); c.Abnormal || n.refresher.tracked("vol") {
+		t.Errorf("condition without expiration = %v, want normal and untracked", c)
+	}
+
+	expired := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	if err := writeFile(dir, expirationFileName, []byte(expired+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if c := n.volumeCondition("vol", dir); !c.Abnormal || !strings.Contains(c.Message, "expired at") {
+		t.Errorf("condition of expired volume staged by an earlier release = %v, want abnormal", c)
+	}
+
+	valid := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if err := writeFile(dir, expirationFileName, []byte(valid+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(dir, stagedFileName, []byte(`{"barName":"bar","barNamespace":"default"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if c := n.volumeCondition("vol", dir); c.Abnormal || !strings.Contains(c.Message, "valid until") {
+		t.Errorf("condition of resumed volume = %v, want valid", c)
+	}
+	if !n.refresher.tracked("vol") {
+		t.Error("refresh of resumed volume not scheduled")
+	}
+}
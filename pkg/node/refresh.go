@@ -0,0 +1,295 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/metrics"
+)
+
+const (
+	expirationFileName   string = `expiration`
+	expirationAnnotation        = "cosi.storage.k8s.io/expiration"
+	// stagedFileName holds the stagedVolume written next to the expiration
+	// file.
+	stagedFileName string = `.staged.json`
+)
+
+// refreshRetryInterval bounds how often a failed refresh is retried.
+var refreshRetryInterval = 10 * time.Second
+
+// expirationKeys are the minted Secret data keys checked, in order, for the
+// time at which the credentials stop being valid.
+var expirationKeys = []string{"expiration", "Expiration", "expirationTime", "expiresAt"}
+
+// parseExpiration returns the RFC3339 expiration carried by the minted Secret
+// or, failing that, the BucketAccess annotation. A zero time means the
+// credentials do not expire.
+func parseExpiration(ba *v1alpha1.BucketAccess, secret *v1.Secret) (time.Time, error) {
+	for _, k := range expirationKeys {
+		if v, ok := secret.Data[k]; ok {
+			return parseTimestamp(fmt.Sprintf("secret %s/%s key %q", secret.Namespace, secret.Name, k), string(v))
+		}
+	}
+	if v, ok := ba.Annotations[expirationAnnotation]; ok {
+		return parseTimestamp(fmt.Sprintf("bucketAccess %s annotation %q", ba.Name, expirationAnnotation), v)
+	}
+	return time.Time{}, nil
+}
+
+func parseTimestamp(source, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiration in %s: %v", source, err)
+	}
+	return t, nil
+}
+
+// readExpiration returns the expiration written to the staging path dir, or
+// a zero time if there is none.
+func readExpiration(dir string) (time.Time, error) {
+	path := filepath.Join(dir, expirationFileName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	return parseTimestamp(path, string(data))
+}
+
+// stagedVolume names the bucketAccessRequest of a volume with expiring
+// credentials, so that their refresh is resumed after the driver restarts.
+type stagedVolume struct {
+	BARName      string `json:"barName"`
+	BARNamespace string `json:"barNamespace"`
+}
+
+// readStagedVolume returns the stagedVolume written to the staging path dir.
+func readStagedVolume(dir string) (*stagedVolume, error) {
+	path := filepath.Join(dir, stagedFileName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	v := &stagedVolume{}
+	if err := json.Unmarshal(data, v); err != nil || v.BARName == "" || v.BARNamespace == "" {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return v, nil
+}
+
+// unrefreshedCondition reports credentials expiring at expiration that are
+// not refreshed.
+func unrefreshedCondition(expiration time.Time) *csi.VolumeCondition {
+	if !time.Now().Before(expiration) {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("credentials expired at %s", expiration.Format(time.RFC3339))}
+	}
+	return &csi.VolumeCondition{Message: fmt.Sprintf("credentials valid until %s, not refreshed", expiration.Format(time.RFC3339))}
+}
+
+// refreshFunc re-stages a volume's credentials and returns their new expiration.
+type refreshFunc func() (time.Time, error)
+
+type refreshState struct {
+	path       string
+	timer      *time.Timer
+	expiration time.Time
+	condition  *csi.VolumeCondition
+}
+
+// credentialRefresher re-stages expiring credentials once the configured
+// fraction of their remaining lifetime has elapsed, and tracks the resulting
+// volume condition.
+type credentialRefresher struct {
+	lock     sync.Mutex
+	fraction float64
+	volumes  map[string]*refreshState
+	locks    map[string]*volumeLock
+}
+
+// volumeLock serializes the writes to the staging path of a volume.
+type volumeLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newCredentialRefresher(fraction float64) *credentialRefresher {
+	return &credentialRefresher{
+		fraction: fraction,
+		volumes:  make(map[string]*refreshState),
+		locks:    make(map[string]*volumeLock),
+	}
+}
+
+// lockVolume blocks until no stage, unstage or refresh of volumeID is in
+// progress, and returns the function releasing the volume.
+func (r *credentialRefresher) lockVolume(volumeID string) func() {
+	r.lock.Lock()
+	l, ok := r.locks[volumeID]
+	if !ok {
+		l = &volumeLock{}
+		r.locks[volumeID] = l
+	}
+	l.refs++
+	r.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(r.locks, volumeID)
+		}
+	}
+}
+
+// schedule replaces any pending refresh of volumeID, staged at path, with one
+// derived from expiration.
+func (r *credentialRefresher) schedule(volumeID, path string, expiration time.Time, refresh refreshFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s, ok := r.volumes[volumeID]; ok {
+		s.timer.Stop()
+	}
+	s := &refreshState{
+		path:       path,
+		expiration: expiration,
+		condition:  &csi.VolumeCondition{Message: fmt.Sprintf("credentials valid until %s", expiration.Format(time.RFC3339))},
+	}
+	if !time.Now().Before(expiration) {
+		// resumed after a restart, refreshed right away
+		s.condition = unrefreshedCondition(expiration)
+	}
+	r.volumes[volumeID] = s
+	s.timer = r.arm(volumeID, s, r.delay(expiration, 0), refresh)
+}
+
+// delay returns how long to wait before refreshing credentials expiring at expiration.
+func (r *credentialRefresher) delay(expiration time.Time, floor time.Duration) time.Duration {
+	d := time.Duration(float64(time.Until(expiration)) * r.fraction)
+	if d < floor {
+		return floor
+	}
+	return d
+}
+
+func (r *credentialRefresher) arm(volumeID string, s *refreshState, d time.Duration, refresh refreshFunc) *time.Timer {
+	klog.V(4).Infof("refreshing credentials for volume %q in %v", volumeID, d)
+	return time.AfterFunc(d, func() {
+		// a volume unstaged while the timer fired must not be written again
+		unlock := r.lockVolume(volumeID)
+		defer unlock()
+		r.lock.Lock()
+		current := r.volumes[volumeID] == s
+		r.lock.Unlock()
+		if !current {
+			return
+		}
+
+		expiration, err := refresh()
+		metrics.RecordCredentialRefresh(err)
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.volumes[volumeID] != s {
+			// unstaged or rescheduled while refreshing
+			return
+		}
+
+		if err == nil && !expiration.IsZero() && !expiration.After(s.expiration) {
+			err = fmt.Errorf("refreshed credentials expire at %s, no later than the current ones", expiration.Format(time.RFC3339))
+		}
+
+		if err != nil {
+			klog.Errorf("failed to refresh credentials for volume %q: %v", volumeID, err)
+			msg := fmt.Sprintf("credential refresh failed, current credentials expire at %s: %v", s.expiration.Format(time.RFC3339), err)
+			if !time.Now().Before(s.expiration) {
+				msg = fmt.Sprintf("credentials expired at %s and could not be refreshed: %v", s.expiration.Format(time.RFC3339), err)
+			}
+			s.condition = &csi.VolumeCondition{Abnormal: true, Message: msg}
+			s.timer = r.arm(volumeID, s, r.delay(s.expiration, refreshRetryInterval), refresh)
+			return
+		}
+
+		klog.Infof("refreshed credentials for volume %q", volumeID)
+		if expiration.IsZero() {
+			delete(r.volumes, volumeID)
+			return
+		}
+		s.expiration = expiration
+		s.condition = &csi.VolumeCondition{Message: fmt.Sprintf("credentials valid until %s", expiration.Format(time.RFC3339))}
+		s.timer = r.arm(volumeID, s, r.delay(expiration, 0), refresh)
+	})
+}
+
+// cancel stops refreshing volumeID.
+func (r *credentialRefresher) cancel(volumeID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s, ok := r.volumes[volumeID]; ok {
+		s.timer.Stop()
+		delete(r.volumes, volumeID)
+	}
+}
+
+// stop cancels every pending refresh.
+func (r *credentialRefresher) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for volumeID, s := range r.volumes {
+		s.timer.Stop()
+		delete(r.volumes, volumeID)
+	}
+}
+
+// collect stops refreshing volumes whose staging path is gone, which happens
+// when kubelet cleans up a volume while the driver is not running.
+func (r *credentialRefresher) collect() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for volumeID, s := range r.volumes {
+		if _, err := os.Stat(s.path); os.IsNotExist(err) {
+			klog.Infof("staging path %q of volume %q is gone, no longer refreshing its credentials", s.path, volumeID)
+			s.timer.Stop()
+			delete(r.volumes, volumeID)
+		}
+	}
+}
+
+// tracked reports whether a refresh of volumeID is scheduled.
+func (r *credentialRefresher) tracked(volumeID string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.volumes[volumeID]
+	return ok
+}
+
+// condition reports the credential condition of volumeID. Volumes without
+// expiring credentials are always normal.
+func (r *credentialRefresher) condition(volumeID string) *csi.VolumeCondition {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s, ok := r.volumes[volumeID]; ok {
+		return s.condition
+	}
+	return &csi.VolumeCondition{Message: "credentials do not expire"}
+}
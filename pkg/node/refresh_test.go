@@ -0,0 +1,179 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestUnstageWaitsForRefresh checks that unstaging a volume waits for a
+// refresh in progress, and that the volume is not refreshed afterwards.
+func TestUnstageWaitsForRefresh(t *testing.T) {
+	r := newCredentialRefresher(0.5)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	refreshes := 0
+	r.schedule("vol", "", time.Now().Add(10*time.Millisecond), func() (time.Time, error) {
+		refreshes++
+		close(started)
+		<-release
+		return time.Now().Add(10 * time.Millisecond), nil
+	})
+	<-started
+
+	unstaged := make(chan struct{})
+	go func() {
+		unlock := r.lockVolume("vol")
+		defer unlock()
+		r.cancel("vol")
+		close(unstaged)
+	}()
+
+	select {
+	case <-unstaged:
+		t.Fatal("unstage finished while a refresh was writing the volume")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-unstaged
+
+	time.Sleep(50 * time.Millisecond)
+	if refreshes != 1 {
+		t.Errorf("volume refreshed %d times, want 1", refreshes)
+	}
+	if c := r.condition("vol"); c.Abnormal {
+		t.Errorf("condition of unstaged volume = %v, want normal", c)
+	}
+}
+
+func TestParseExpiration(t *testing.T) {
+	const (
+		secretTime     = "2030-01-02T03:04:05Z"
+		annotationTime = "2031-01-02T03:04:05Z"
+	)
+	annotated := &v1alpha1.BucketAccess{ObjectMeta: metav1.ObjectMeta{
+		Name:        "ba",
+		Annotations: map[string]string{expirationAnnotation: annotationTime},
+	}}
+	tests := []struct {
+		name   string
+		ba     *v1alpha1.BucketAccess
+		secret map[string][]byte
+		want   string
+		err    bool
+	}{
+		{name: "none", ba: &v1alpha1.BucketAccess{}},
+		{name: "annotation", ba: annotated, want: annotationTime},
+		{name: "secret before annotation", ba: annotated, secret: map[string][]byte{"expiresAt": []byte(secretTime)}, want: secretTime},
+		{
+			name:   "secret keys in order",
+			ba:     &v1alpha1.BucketAccess{},
+			secret: map[string][]byte{"expiration": []byte(secretTime + "\n"), "expiresAt": []byte(annotationTime)},
+			want:   secretTime,
+		},
+		{name: "invalid secret value", ba: annotated, secret: map[string][]byte{"expiration": []byte("1893553445")}, err: true},
+		{
+			name: "invalid annotation",
+			ba:   &v1alpha1.BucketAccess{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{expirationAnnotation: "tomorrow"}}},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseExpiration(test.ba, &v1.Secret{Data: test.secret})
+			if test.err {
+				if err == nil {
+					t.Errorf("parseExpiration() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExpiration() = %v", err)
+			}
+			var want time.Time
+			if test.want != "" {
+				want, _ = time.Parse(time.RFC3339, test.want)
+			}
+			if !got.Equal(want) {
+				t.Errorf("parseExpiration() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	r := newCredentialRefresher(0.25)
+	d := r.delay(time.Now().Add(time.Hour), 0)
+	if d > 15*time.Minute || d < 14*time.Minute {
+		t.Errorf("delay() = %v, want a quarter of an hour", d)
+	}
+	if d := r.delay(time.Now().Add(time.Minute), time.Minute); d != time.Minute {
+		t.Errorf("delay() = %v, want the floor of 1m0s", d)
+	}
+	if d := r.delay(time.Now().Add(-time.Minute), 0); d > 0 {
+		t.Errorf("delay() of expired credentials = %v, want none", d)
+	}
+}
+
+// TestRefreshCondition checks that a failed refresh makes the volume
+// abnormal until a retry succeeds.
+func TestRefreshCondition(t *testing.T) {
+	defer func(d time.Duration) { refreshRetryInterval = d }(refreshRetryInterval)
+	refreshRetryInterval = 10 * time.Millisecond
+
+	r := newCredentialRefresher(0.5)
+	defer r.stop()
+	fail := make(chan bool)
+	r.schedule("vol", "", time.Now().Add(time.Second), func() (time.Time, error) {
+		if <-fail {
+			return time.Time{}, errors.New("minting failed")
+		}
+		return time.Now().Add(time.Hour), nil
+	})
+
+	fail <- true
+	waitForCondition(t, r, func(c *csi.VolumeCondition) bool {
+		return c.Abnormal && strings.Contains(c.Message, "current credentials expire at") && strings.Contains(c.Message, "minting failed")
+	})
+	fail <- false
+	waitForCondition(t, r, func(c *csi.VolumeCondition) bool {
+		return !c.Abnormal && strings.Contains(c.Message, "valid until")
+	})
+}
+
+func waitForCondition(t *testing.T, r *credentialRefresher, ok func(*csi.VolumeCondition) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c := r.condition("vol")
+		if ok(c) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("condition = %v", c)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/klog"
+	"k8s.io/utils/mount"
+)
+
+// mountTmpfs mounts a tmpfs of size bytes at path, unless something is
+// mounted there already, so that credentials never reach the node's disk.
+func mountTmpfs(path string, size int64) error {
+	m := mount.New("")
+	notMnt, err := m.IsLikelyNotMountPoint(path)
+	if err != nil {
+		return fmt.Errorf("unable to check mount point %s: %v", path, err)
+	}
+	if !notMnt {
+		return nil
+	}
+	klog.Infof("mounting tmpfs of %d bytes at %s", size, path)
+	if err := m.Mount("tmpfs", path, "tmpfs", []string{fmt.Sprintf("size=%d", size), "mode=0755"}); err != nil {
+		return fmt.Errorf("unable to mount tmpfs at %s: %v", path, err)
+	}
+	return nil
+}
+
+// unmountTmpfs unmounts the tmpfs mounted at path by mountTmpfs, if any.
+func unmountTmpfs(path string) error {
+	m := mount.New("")
+	notMnt, err := m.IsLikelyNotMountPoint(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case mount.IsCorruptedMnt(err):
+		notMnt = false
+	case err != nil:
+		return fmt.Errorf("unable to check mount point %s: %v", path, err)
+	}
+	if notMnt {
+		return nil
+	}
+	klog.Infof("unmounting tmpfs at %s", path)
+	if err := m.Unmount(path); err != nil {
+		return fmt.Errorf("unable to unmount tmpfs at %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package node
+
+import (
+	"strings"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validateProtocol checks that the bucket's protocol section matching its
+// protocol name carries the fields consumers need to connect.
+func validateProtocol(bkt *v1alpha1.Bucket) error {
+	p := bkt.Spec.Protocol
+	var missing []string
+	require := func(field, value string) {
+		if value == "" {
+			missing = append(missing, field)
+		}
+	}
+
+	switch p.ProtocolName {
+	case v1alpha1.ProtocolNameS3:
+		if p.S3 == nil {
+			return status.Errorf(codes.FailedPrecondition, "bucket %q has protocol %q but no s3 section", bkt.Name, p.ProtocolName)
+		}
+		require("s3.endpoint", p.S3.Endpoint)
+		require("s3.bucketName", p.S3.BucketName)
+	case v1alpha1.ProtocolNameAzure:
+		if p.AzureBlob == nil {
+			return status.Errorf(codes.FailedPrecondition, "bucket %q has protocol %q but no azureBlob section", bkt.Name, p.ProtocolName)
+		}
+		require("azureBlob.storageAccount", p.AzureBlob.StorageAccount)
+		require("azureBlob.containerName", p.AzureBlob.ContainerName)
+	case v1alpha1.ProtocolNameGCS:
+		if p.GCS == nil {
+			return status.Errorf(codes.FailedPrecondition, "bucket %q has protocol %q but no gcs section", bkt.Name, p.ProtocolName)
+		}
+		require("gcs.bucketName", p.GCS.BucketName)
+		require("gcs.projectID", p.GCS.ProjectID)
+	case "":
+		return status.Errorf(codes.FailedPrecondition, "bucket %q protocol not set", bkt.Name)
+	default:
+		return status.Errorf(codes.InvalidArgument, "bucket %q has unrecognized protocol %q, unable to extract connection data", bkt.Name, p.ProtocolName)
+	}
+
+	if len(missing) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "bucket %q protocol %q is missing required fields: %s", bkt.Name, p.ProtocolName, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-object-storage-interface/api/apis/objectstorage.k8s.io/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateProtocol(t *testing.T) {
+	s3 := func() *v1alpha1.S3Protocol {
+		return &v1alpha1.S3Protocol{Endpoint: "https://s3.example.com", BucketName: "bucket"}
+	}
+	azure := func() *v1alpha1.AzureProtocol {
+		return &v1alpha1.AzureProtocol{StorageAccount: "account", ContainerName: "container"}
+	}
+	gcs := func() *v1alpha1.GCSProtocol {
+		return &v1alpha1.GCSProtocol{BucketName: "bucket", ProjectID: "project"}
+	}
+
+	tests := []struct {
+		name     string
+		protocol v1alpha1.Protocol
+		code     codes.Code
+		// fields are the names the error message must contain
+		fields []string
+	}{
+		{
+			name:     "s3",
+			protocol: v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameS3, S3: s3()},
+			code:     codes.OK,
+		},
+		{
+			name:     "s3 section missing",
+			protocol: v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameS3},
+			code:     codes.FailedPrecondition,
+			fields:   []string{"s3 section"},
+		},
+		{
+			name: "s3 endpoint missing",
+			protocol: func() v1alpha1.Protocol {
+				p := s3()
+				p.Endpoint = ""
+				return v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameS3, S3: p}
+			}(),
+			code:   codes.FailedPrecondition,
+			fields: []string{"s3.endpoint"},
+		},
+		{
+			name: "s3 bucketName missing",
+			protocol: func() v1alpha1.Protocol {
+				p := s3()
+				p.BucketName = ""
+				return v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameS3, S3: p}
+			}(),
+			code:   codes.FailedPrecondition,
+			fields: []string{"s3.bucketName"},
+		},
+		{
+			name:     "s3 all fields missing",
+			protocol: v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameS3, S3: &v1alpha1.S3Protocol{}},
+			code:     codes.FailedPrecondition,
+			fields:   []string{"s3.endpoint", "s3.bucketName"},
+		},
+		{
+			name:     "azure",
+			protocol: v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameAzure, AzureBlob: azure()},
+			code:     codes.OK,
+		},
+		{
+			name:     "azure section missing",
+			protocol: v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameAzure},
+			code:     codes.FailedPrecondition,
+			fields:   []string{"azureBlob section"},
+		},
+		{
+			name: "azure storageAccount missing",
+			protocol: func() v1alpha1.Protocol {
+				p := azure()
+				p.StorageAccount = ""
+				return v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameAzure, AzureBlob: p}
+			}(),
+			code:   codes.FailedPrecondition,
+			fields: []string{"azureBlob.storageAccount"},
+		},
+		{
+			name: "azure containerName missing",
+			protocol: func() v1alpha1.Protocol {
+				p := azure()
+				p.ContainerName = ""
+				return v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameAzure, AzureBlob: p}
+			}(),
+			code:   codes.FailedPrecondition,
+			fields: []string{"azureBlob.containerName"},
+		},
+		{
+			name:     "gcs",
+			protocol: v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameGCS, GCS: gcs()},
+			code:     codes.OK,
+		},
+		{
+			name:     "gcs section missing",
+			protocol: v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameGCS},
+			code:     codes.FailedPrecondition,
+			fields:   []string{"gcs section"},
+		},
+		{
+			name: "gcs bucketName missing",
+			protocol: func() v1alpha1.Protocol {
+				p := gcs()
+				p.BucketName = ""
+				return v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameGCS, GCS: p}
+			}(),
+			code:   codes.FailedPrecondition,
+			fields: []string{"gcs.bucketName"},
+		},
+		{
+			name: "gcs projectID missing",
+			protocol: func() v1alpha1.Protocol {
+				p := gcs()
+				p.ProjectID = ""
+				return v1alpha1.Protocol{ProtocolName: v1alpha1.ProtocolNameGCS, GCS: p}
+			}(),
+			code:   codes.FailedPrecondition,
+			fields: []string{"gcs.projectID"},
+		},
+		{
+			name:     "empty protocol",
+			protocol: v1alpha1.Protocol{S3: s3()},
+			code:     codes.FailedPrecondition,
+			fields:   []string{"protocol not set"},
+		},
+		{
+			name:     "unknown protocol",
+			protocol: v1alpha1.Protocol{ProtocolName: "ftp", S3: s3()},
+			code:     codes.InvalidArgument,
+			fields:   []string{`"ftp"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bkt := &v1alpha1.Bucket{
+				ObjectMeta: metav1.ObjectMeta{Name: "bucket"},
+				Spec:       v1alpha1.BucketSpec{Protocol: test.protocol},
+			}
+			err := validateProtocol(bkt)
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("validateProtocol() code = %v, want %v: %v", code, test.code, err)
+			}
+			for _, f := range test.fields {
+				if !strings.Contains(status.Convert(err).Message(), f) {
+					t.Errorf("validateProtocol() = %v, want message naming %s", err, f)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+// healthCheckTimeout bounds every health check.
+const healthCheckTimeout = 5 * time.Second
+
+// Check returns why a component is unhealthy, or nil.
+type Check func(ctx context.Context) error
+
+// HealthHandler serves /healthz, failing if a liveness check fails, and
+// /readyz, failing if a liveness or readiness check fails.
+func HealthHandler(liveness, readiness map[string]Check) http.Handler {
+	ready := make(map[string]Check, len(liveness)+len(readiness))
+	for name, c := range liveness {
+		ready[name] = c
+	}
+	for name, c := range readiness {
+		ready[name] = c
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", checkHandler(liveness))
+	mux.Handle("/readyz", checkHandler(ready))
+	return mux
+}
+
+// checkHandler runs checks and lists their results.
+func checkHandler(checks map[string]Check) http.Handler {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		var out bytes.Buffer
+		failed := false
+		for _, name := range names {
+			if err := checks[name](ctx); err != nil {
+				klog.Warningf("%s check %q failed: %v", r.URL.Path, name, err)
+				fmt.Fprintf(&out, "[-]%s failed: %v\n", name, err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(&out, "[+]%s ok\n", name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		out.WriteTo(w)
+	})
+}
+
+// Check calls Probe through the endpoint, failing if the server does not
+// answer.
+func (s *Server) Check(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, s.address,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, s.network, address)
+		}))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s://%s: %v", s.network, s.address, err)
+	}
+	defer conn.Close()
+
+	if _, err := csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{}); err != nil {
+		return fmt.Errorf("probe failed: %v", err)
+	}
+	return nil
+}
+
+// StateDir returns the directory of the unix socket, or "" for a tcp endpoint.
+func (s *Server) StateDir() string {
+	if s.network != "unix" {
+		return ""
+	}
+	return filepath.Dir(s.address)
+}
+
+// CheckWritable returns a Check that fails unless a file can be created in dir.
+func CheckWritable(dir string) Check {
+	return func(ctx context.Context) error {
+		f, err := ioutil.TempFile(dir, ".healthz")
+		if err != nil {
+			return fmt.Errorf("directory %q is not writable: %v", dir, err)
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
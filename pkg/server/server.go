@@ -0,0 +1,172 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+
+	"github.com/container-object-storage-interface/ephemeral-csi-driver/pkg/metrics"
+)
+
+// ParseEndpoint splits a CSI endpoint, unix:///path/to/csi.sock or
+// tcp://host:port, into its network and address.
+func ParseEndpoint(endpoint string) (string, string, error) {
+	parts := strings.SplitN(endpoint, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid endpoint %q, must be unix:///path/to/socket or tcp://host:port", endpoint)
+	}
+	network := strings.ToLower(parts[0])
+	switch network {
+	case "unix", "tcp":
+		return network, parts[1], nil
+	}
+	return "", "", fmt.Errorf("invalid endpoint %q, scheme %q is not one of unix, tcp", endpoint, parts[0])
+}
+
+// Server serves the CSI services on an endpoint.
+type Server struct {
+	network    string
+	address    string
+	socketMode os.FileMode
+
+	server *grpc.Server
+	done   chan error
+}
+
+// New returns a Server for endpoint, whose unix socket, if any, is created
+// with socketMode. The services that are nil are not registered.
+func New(endpoint string, socketMode os.FileMode, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) (*Server, error) {
+	network, address, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(logGRPC, metrics.UnaryServerInterceptor))
+	if ids != nil {
+		csi.RegisterIdentityServer(server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(server, ns)
+	}
+	return &Server{
+		network:    network,
+		address:    address,
+		socketMode: socketMode,
+		server:     server,
+		done:       make(chan error, 1),
+	}, nil
+}
+
+// Start listens on the endpoint and serves in the background.
+func (s *Server) Start() error {
+	if s.network == "unix" {
+		if err := removeSocket(s.address); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(s.address), 0755); err != nil {
+			return fmt.Errorf("failed to create socket directory: %v", err)
+		}
+	}
+
+	listener, err := net.Listen(s.network, s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s://%s: %v", s.network, s.address, err)
+	}
+	if s.network == "unix" {
+		if err := os.Chmod(s.address, s.socketMode); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to set permissions of socket %q: %v", s.address, err)
+		}
+	}
+
+	klog.Infof("listening for connections on %s://%s", s.network, listener.Addr())
+	go func() {
+		s.done <- s.server.Serve(listener)
+	}()
+	return nil
+}
+
+// Wait blocks until the server stops serving.
+func (s *Server) Wait() error {
+	return <-s.done
+}
+
+// Stop stops serving, letting in-flight calls finish within timeout before
+// they are cancelled, and removes the unix socket.
+func (s *Server) Stop(timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		klog.Warningf("in-flight calls did not finish within %v, cancelling them", timeout)
+		s.server.Stop()
+		<-stopped
+	}
+
+	if s.network == "unix" {
+		if err := os.Remove(s.address); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("failed to remove socket %q: %v", s.address, err)
+		}
+	}
+}
+
+// removeSocket removes a socket left behind by a previous run, refusing to
+// remove anything but a socket.
+func removeSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat socket %q: %v", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %q, it is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %q: %v", path, err)
+	}
+	return nil
+}
+
+// logGRPC logs every call and its error. Requests are not logged since they
+// may carry secrets.
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	klog.V(3).Infof("GRPC call: %s", info.FullMethod)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		klog.Errorf("GRPC error: %s: %v", info.FullMethod, err)
+	}
+	return resp, err
+}